@@ -0,0 +1,191 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+//go:embed ui
+var uiFiles embed.FS
+
+func uiHandler() http.Handler {
+	files, err := fs.Sub(uiFiles, "ui")
+	if err != nil {
+		panic(err)
+	}
+	return http.StripPrefix("/admin/", http.FileServer(http.FS(files)))
+}
+
+func setRuleDisabled(name string, disabled bool, source string) (Config, error) {
+	return updateConfig(source, func(cfg *Config) error {
+		rules := make([]Rule, len(cfg.Rules))
+		copy(rules, cfg.Rules)
+		for i := range rules {
+			if rules[i].Name == name {
+				rules[i].Disabled = disabled
+				cfg.Rules = rules
+				return nil
+			}
+		}
+		return errNotFound(fmt.Sprintf("No rule named %q", name))
+	})
+}
+
+// rulesHandler turns single rules on and off without resending the whole
+// configuration.
+func rulesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var toggle struct {
+		Name     string `json:"name"`
+		Disabled bool   `json:"disabled"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&toggle); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	cfg, err := setRuleDisabled(toggle.Name, toggle.Disabled, "admin:"+r.RemoteAddr)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	writeJSON(w, cfg.Rules)
+}
+
+// schedule enables a rule for a while, optionally after a delay, and
+// disables it again afterwards.
+type schedule struct {
+	ID       int       `json:"id"`
+	Rule     string    `json:"rule"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Active   bool      `json:"active"`
+	startTmr *time.Timer
+	endTmr   *time.Timer
+}
+
+type scheduler struct {
+	lock      sync.Mutex
+	nextID    int
+	schedules map[int]*schedule
+}
+
+var schedules = &scheduler{schedules: map[int]*schedule{}}
+
+func (s *scheduler) add(rule string, after, duration time.Duration) (*schedule, error) {
+	found := false
+	for _, r := range currentConfig().Rules {
+		found = found || r.Name == rule
+	}
+	if !found {
+		return nil, errNotFound(fmt.Sprintf("No rule named %q", rule))
+	}
+	if after < 0 || duration <= 0 {
+		return nil, fmt.Errorf("after must not be negative and duration must be positive")
+	}
+	if after > 0 {
+		if _, err := setRuleDisabled(rule, true, "schedule"); err != nil {
+			return nil, err
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.nextID++
+	start := time.Now().Add(after)
+	sched := &schedule{ID: s.nextID, Rule: rule, Start: start, End: start.Add(duration)}
+	source := fmt.Sprintf("schedule:%d", sched.ID)
+
+	sched.startTmr = time.AfterFunc(after, func() {
+		s.lock.Lock()
+		sched.Active = true
+		s.lock.Unlock()
+		if _, err := setRuleDisabled(rule, false, source); err != nil {
+			log.Printf("Schedule %d could not enable %s: %s\n", sched.ID, rule, err)
+		}
+	})
+	sched.endTmr = time.AfterFunc(after+duration, func() {
+		s.lock.Lock()
+		delete(s.schedules, sched.ID)
+		s.lock.Unlock()
+		if _, err := setRuleDisabled(rule, true, source); err != nil {
+			log.Printf("Schedule %d could not disable %s: %s\n", sched.ID, rule, err)
+		}
+	})
+	s.schedules[sched.ID] = sched
+	return sched, nil
+}
+
+func (s *scheduler) list() []schedule {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	out := []schedule{}
+	for _, sched := range s.schedules {
+		out = append(out, *sched)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+func (s *scheduler) cancelAll() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for id, sched := range s.schedules {
+		sched.startTmr.Stop()
+		sched.endTmr.Stop()
+		delete(s.schedules, id)
+	}
+}
+
+func schedulesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, schedules.list())
+	case http.MethodPost:
+		var req struct {
+			Rule     string   `json:"rule"`
+			After    Duration `json:"after"`
+			Duration Duration `json:"duration"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sched, err := schedules.add(req.Rule, time.Duration(req.After), time.Duration(req.Duration))
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+		writeJSON(w, sched)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// resetHandler cancels all schedules, clears the counters and goes back to
+// the default configuration.
+func resetHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	schedules.cancelAll()
+	counters.reset(time.Now())
+	if err := setConfig(defaultConfig(), "reset:"+r.RemoteAddr); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, currentConfig())
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+type auditEntry struct {
+	Time   time.Time `json:"time"`
+	Source string    `json:"source"`
+	Diff   []string  `json:"diff"`
+}
+
+var (
+	auditLock    sync.Mutex
+	auditEntries []auditEntry
+	auditFile    *os.File
+)
+
+// openAuditLog loads the entries already recorded in path and keeps the file
+// open so that further changes are appended to it.
+func openAuditLog(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var entry auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			log.Printf("Skipping malformed audit entry in %s: %s\n", path, err)
+			continue
+		}
+		auditEntries = append(auditEntries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return err
+	}
+
+	auditFile = f
+	return nil
+}
+
+func recordAudit(source string, diff []string) {
+	entry := auditEntry{
+		Time:   time.Now().UTC(),
+		Source: source,
+		Diff:   diff,
+	}
+
+	auditLock.Lock()
+	defer auditLock.Unlock()
+	auditEntries = append(auditEntries, entry)
+	log.Printf("Config changed by %s (%d changed lines)\n", source, len(diff))
+
+	if auditFile == nil {
+		return
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Failed to encode audit entry: %s\n", err)
+		return
+	}
+	if _, err := auditFile.Write(append(line, '\n')); err != nil {
+		log.Printf("Failed to write audit entry: %s\n", err)
+	}
+}
+
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	auditLock.Lock()
+	entries := make([]auditEntry, len(auditEntries))
+	copy(entries, auditEntries)
+	auditLock.Unlock()
+
+	writeJSON(w, entries)
+}
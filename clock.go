@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+const (
+	faultDateSkew         = "date_skew"
+	faultExpiresSkew      = "expires_skew"
+	faultLastModifiedSkew = "last_modified_skew"
+
+	tokenLifetime = time.Hour
+)
+
+// skewedNow is the time as seen by this instance, shifted by its clock_offset.
+// The timestamps failserver hands to clients, in headers and tokens, go
+// through it; the audit log, schedules and other bookkeeping use the real
+// clock.
+func skewedNow() time.Time {
+	return time.Now().Add(time.Duration(settings.ClockOffset))
+}
+
+// applyClockHeaders sets the time related response headers, skewed by the
+// clock faults that trigger for r.
+func applyClockHeaders(w http.ResponseWriter, r *http.Request, cfg Config) {
+	t := skewedNow().UTC()
+	w.Header().Set("Date", t.Format(http.TimeFormat))
+
+	for _, rule := range cfg.Rules {
+		var header string
+		switch rule.Type {
+		case faultDateSkew:
+			header = "Date"
+		case faultExpiresSkew:
+			header = "Expires"
+		case faultLastModifiedSkew:
+			header = "Last-Modified"
+		default:
+			continue
+		}
+		if rule.triggers(r) {
+			injectFault(rule)
+			w.Header().Set(header, t.Add(time.Duration(rule.Skew)).Format(http.TimeFormat))
+		}
+	}
+}
+
+func base64JSON(v interface{}) string {
+	data, _ := json.Marshal(v)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// signToken builds an HS256 JWT for subject whose timestamps come from the
+// instance clock, so clients validating them see the configured skew.
+func signToken(subject string) string {
+	issued := skewedNow()
+	header := base64JSON(map[string]string{"alg": "HS256", "typ": "JWT"})
+	claims := base64JSON(map[string]interface{}{
+		"iss": "failserver",
+		"sub": subject,
+		"iat": issued.Unix(),
+		"nbf": issued.Unix(),
+		"exp": issued.Add(tokenLifetime).Unix(),
+	})
+
+	mac := hmac.New(sha256.New, []byte(settings.JWTSecret))
+	mac.Write([]byte(header + "." + claims))
+	return header + "." + claims + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func tokenHandler(w http.ResponseWriter, r *http.Request) {
+	subject := r.URL.Query().Get("sub")
+	if subject == "" {
+		subject = "anonymous"
+	}
+	applyClockHeaders(w, r, currentConfig())
+	writeJSON(w, map[string]interface{}{
+		"access_token": signToken(subject),
+		"token_type":   "Bearer",
+		"expires_in":   int(tokenLifetime.Seconds()),
+	})
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	clusterSyncInterval = time.Second
+	clusterPeerTimeout  = 5 * clusterSyncInterval
+)
+
+var (
+	clusterMembers = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "failserver_cluster_members",
+			Help: "Number of cluster nodes this node has heard from recently, itself included",
+		},
+	)
+	clusterPeerUp = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "failserver_cluster_peer_up",
+			Help: "Whether the last state exchange with a peer succeeded",
+		},
+		[]string{"peer"},
+	)
+)
+
+// clusterMessage is exchanged in both directions on every sync: the dialing
+// node sends its state and the listening node answers with its own.
+type clusterMessage struct {
+	Node         string                      `json:"node"`
+	Stamp        configStamp                 `json:"stamp"`
+	Config       Config                      `json:"config"`
+	Counters     map[string]map[string]int64 `json:"counters"`
+	CounterEpoch int64                       `json:"counter_epoch"`
+}
+
+// clusterEnvelope carries a clusterMessage together with its HMAC under
+// cluster_secret, when one is set.
+type clusterEnvelope struct {
+	MAC     string          `json:"mac,omitempty"`
+	Message json.RawMessage `json:"message"`
+}
+
+func clusterMAC(message []byte) string {
+	mac := hmac.New(sha256.New, []byte(settings.ClusterSecret))
+	mac.Write(message)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func writeClusterMessage(w io.Writer, msg clusterMessage) error {
+	message, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	envelope := clusterEnvelope{Message: message}
+	if settings.ClusterSecret != "" {
+		envelope.MAC = clusterMAC(message)
+	}
+	return json.NewEncoder(w).Encode(envelope)
+}
+
+// readClusterMessage reads a message, rejecting it unless it is signed with
+// cluster_secret when one is set.
+func readClusterMessage(r io.Reader) (clusterMessage, error) {
+	var envelope clusterEnvelope
+	var msg clusterMessage
+	if err := json.NewDecoder(r).Decode(&envelope); err != nil {
+		return msg, err
+	}
+	if settings.ClusterSecret != "" && !hmac.Equal([]byte(envelope.MAC), []byte(clusterMAC(envelope.Message))) {
+		return msg, fmt.Errorf("message is not signed with cluster_secret")
+	}
+	err := json.Unmarshal(envelope.Message, &msg)
+	return msg, err
+}
+
+// cluster keeps replicas consistent by periodically exchanging the fault
+// configuration and the shared counters with every configured peer.
+type cluster struct {
+	addr     string
+	peers    []string
+	listener net.Listener
+	closed   chan struct{}
+
+	lock     sync.Mutex
+	lastSeen map[string]time.Time
+}
+
+func newCluster(addr string, peers []string) *cluster {
+	return &cluster{
+		addr:     addr,
+		peers:    peers,
+		closed:   make(chan struct{}),
+		lastSeen: map[string]time.Time{},
+	}
+}
+
+func (c *cluster) localState() clusterMessage {
+	cfg, stamp := currentConfigStamp()
+	counts, epoch := counters.snapshot()
+	return clusterMessage{
+		Node:         settings.NodeID,
+		Stamp:        stamp,
+		Config:       cfg,
+		Counters:     counts,
+		CounterEpoch: epoch,
+	}
+}
+
+func (c *cluster) receive(msg clusterMessage) {
+	if msg.Node == "" || msg.Node == settings.NodeID {
+		return
+	}
+	c.lock.Lock()
+	c.lastSeen[msg.Node] = time.Now()
+	c.lock.Unlock()
+
+	counters.merge(msg.Counters, msg.CounterEpoch)
+	if err := mergeConfig(msg.Config, msg.Stamp, "cluster:"+msg.Node); err != nil {
+		log.Printf("Ignoring config from %s: %s\n", msg.Node, err)
+	}
+}
+
+func (c *cluster) listen() error {
+	listener, err := net.Listen("tcp", c.addr)
+	if err != nil {
+		return err
+	}
+	c.listener = listener
+	go func() {
+		var delay time.Duration
+		for {
+			conn, err := listener.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				// back off like net/http does, e.g. when out of file descriptors
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				log.Printf("Cluster accept failed, retrying in %s: %s\n", delay, err)
+				time.Sleep(delay)
+				continue
+			}
+			delay = 0
+			go c.serve(conn)
+		}
+	}()
+	return nil
+}
+
+func (c *cluster) serve(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(clusterSyncInterval))
+
+	msg, err := readClusterMessage(conn)
+	if err != nil {
+		log.Printf("Bad cluster message from %s: %s\n", conn.RemoteAddr(), err)
+		return
+	}
+	if err := writeClusterMessage(conn, c.localState()); err != nil {
+		log.Printf("Failed to answer %s: %s\n", conn.RemoteAddr(), err)
+	}
+	c.receive(msg)
+}
+
+func (c *cluster) exchange(peer string) error {
+	conn, err := net.DialTimeout("tcp", peer, clusterSyncInterval)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(clusterSyncInterval))
+
+	if err := writeClusterMessage(conn, c.localState()); err != nil {
+		return err
+	}
+	msg, err := readClusterMessage(conn)
+	if err != nil {
+		return err
+	}
+	c.receive(msg)
+	return nil
+}
+
+func (c *cluster) sync() {
+	for _, peer := range c.peers {
+		if err := c.exchange(peer); err != nil {
+			clusterPeerUp.With(prometheus.Labels{"peer": peer}).Set(0)
+			continue
+		}
+		clusterPeerUp.With(prometheus.Labels{"peer": peer}).Set(1)
+	}
+
+	c.lock.Lock()
+	members := 1
+	for node, seen := range c.lastSeen {
+		if time.Since(seen) < clusterPeerTimeout {
+			members++
+		} else {
+			delete(c.lastSeen, node)
+		}
+	}
+	c.lock.Unlock()
+	clusterMembers.Set(float64(members))
+}
+
+func (c *cluster) run() {
+	ticker := time.NewTicker(clusterSyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.sync()
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+// close stops accepting and sending state, so nothing from other replicas
+// changes this one while it shuts down.
+func (c *cluster) close() {
+	close(c.closed)
+	if c.listener != nil {
+		c.listener.Close()
+	}
+}
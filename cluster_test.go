@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestClusterMessageSigning(t *testing.T) {
+	tests := []struct {
+		name         string
+		writerSecret string
+		readerSecret string
+		wantErr      bool
+	}{
+		{"no secret", "", "", false},
+		{"same secret", "s3", "s3", false},
+		{"unsigned", "", "s3", true},
+		{"other secret", "other", "s3", true},
+		{"signed, reader without secret", "s3", "", false},
+	}
+	defer func(secret string) { settings.ClusterSecret = secret }(settings.ClusterSecret)
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		settings.ClusterSecret = tt.writerSecret
+		if err := writeClusterMessage(&buf, clusterMessage{Node: "a", CounterEpoch: 7}); err != nil {
+			t.Fatal(err)
+		}
+		settings.ClusterSecret = tt.readerSecret
+		msg, err := readClusterMessage(&buf)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error %v, want error: %t", tt.name, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && (msg.Node != "a" || msg.CounterEpoch != 7) {
+			t.Errorf("%s: got %+v", tt.name, msg)
+		}
+	}
+}
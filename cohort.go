@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	defaultUserIDHeader = "X-User-ID"
+	clientZoneHeader    = "X-Client-Zone"
+)
+
+// Cohort restricts a rule to a subset of clients. Every criterion that is set
+// must match for a request to be part of the cohort.
+type Cohort struct {
+	CIDRs        []string `json:"cidrs,omitempty"`
+	Header       string   `json:"header,omitempty"`
+	Values       []string `json:"values,omitempty"`
+	Percent      float64  `json:"percent,omitempty"`
+	UserIDHeader string   `json:"user_id_header,omitempty"`
+	Zones        []string `json:"zones,omitempty"`
+}
+
+func parseCIDR(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address %q", s)
+		}
+		bits := 8 * net.IPv4len
+		if ip.To4() == nil {
+			bits = 8 * net.IPv6len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, network, err := net.ParseCIDR(s)
+	return network, err
+}
+
+func clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// userBucket maps a user ID to a stable bucket in [0, 10000) so that the same
+// users stay in a percentage cohort across requests and replicas.
+func userBucket(userID string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(userID))
+	return h.Sum32() % 10000
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Cohort) matches(r *http.Request) bool {
+	if len(c.CIDRs) > 0 {
+		ip := clientIP(r)
+		found := false
+		for _, cidr := range c.CIDRs {
+			if network, err := parseCIDR(cidr); err == nil && ip != nil && network.Contains(ip) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if c.Header != "" {
+		value := r.Header.Get(c.Header)
+		if len(c.Values) == 0 && value == "" {
+			return false
+		}
+		if len(c.Values) > 0 && !containsFold(c.Values, value) {
+			return false
+		}
+	}
+
+	if c.Percent > 0 {
+		header := c.UserIDHeader
+		if header == "" {
+			header = defaultUserIDHeader
+		}
+		userID := r.Header.Get(header)
+		if userID == "" || float64(userBucket(userID)) >= c.Percent*100 {
+			return false
+		}
+	}
+
+	if len(c.Zones) > 0 && !containsFold(c.Zones, r.Header.Get(clientZoneHeader)) {
+		return false
+	}
+	return true
+}
+
+func (c *Cohort) validate(prefix string) []string {
+	var problems []string
+	for _, cidr := range c.CIDRs {
+		if _, err := parseCIDR(cidr); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", prefix, err))
+		}
+	}
+	if len(c.Values) > 0 && c.Header == "" {
+		problems = append(problems, prefix+": values need a header")
+	}
+	if c.Percent < 0 || c.Percent > 100 {
+		problems = append(problems, fmt.Sprintf("%s: percent %v is outside [0, 100]", prefix, c.Percent))
+	}
+	if c.UserIDHeader != "" && c.Percent == 0 {
+		problems = append(problems, prefix+": user_id_header needs a percent")
+	}
+	return problems
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCohortMatches(t *testing.T) {
+	// find users on both sides of a 50% cohort
+	var inside, outside string
+	for i := 0; inside == "" || outside == ""; i++ {
+		user := fmt.Sprintf("user-%d", i)
+		if userBucket(user) < 5000 {
+			inside = user
+		} else {
+			outside = user
+		}
+	}
+
+	tests := []struct {
+		name       string
+		cohort     Cohort
+		remoteAddr string
+		headers    map[string]string
+		want       bool
+	}{
+		{name: "empty cohort", want: true},
+		{name: "ip in CIDR", cohort: Cohort{CIDRs: []string{"10.0.0.0/8"}}, remoteAddr: "10.1.2.3:1234", want: true},
+		{name: "ip outside CIDR", cohort: Cohort{CIDRs: []string{"10.0.0.0/8"}}, remoteAddr: "192.168.0.1:1234"},
+		{name: "single address", cohort: Cohort{CIDRs: []string{"192.168.0.1", "10.0.0.0/8"}}, remoteAddr: "192.168.0.1:1234", want: true},
+		{name: "IPv6", cohort: Cohort{CIDRs: []string{"fd00::/8"}}, remoteAddr: "[fd00::1]:1234", want: true},
+		{name: "remote address without port", cohort: Cohort{CIDRs: []string{"10.0.0.1"}}, remoteAddr: "10.0.0.1", want: true},
+		{name: "unparsable remote address", cohort: Cohort{CIDRs: []string{"10.0.0.0/8"}}, remoteAddr: "somewhere"},
+		{name: "header present", cohort: Cohort{Header: "X-Beta"}, headers: map[string]string{"X-Beta": "1"}, want: true},
+		{name: "header missing", cohort: Cohort{Header: "X-Beta"}},
+		{name: "header value", cohort: Cohort{Header: "X-Plan", Values: []string{"free", "trial"}}, headers: map[string]string{"X-Plan": "TRIAL"}, want: true},
+		{name: "other header value", cohort: Cohort{Header: "X-Plan", Values: []string{"free"}}, headers: map[string]string{"X-Plan": "paid"}},
+		{name: "user inside percent", cohort: Cohort{Percent: 50}, headers: map[string]string{"X-User-ID": inside}, want: true},
+		{name: "user outside percent", cohort: Cohort{Percent: 50}, headers: map[string]string{"X-User-ID": outside}},
+		{name: "percent without user", cohort: Cohort{Percent: 100}},
+		{name: "custom user header", cohort: Cohort{Percent: 100, UserIDHeader: "X-Account"}, headers: map[string]string{"X-Account": "a"}, want: true},
+		{name: "zone", cohort: Cohort{Zones: []string{"zone-a"}}, headers: map[string]string{"X-Client-Zone": "Zone-A"}, want: true},
+		{name: "other zone", cohort: Cohort{Zones: []string{"zone-a"}}, headers: map[string]string{"X-Client-Zone": "zone-b"}},
+		{
+			name:       "every criterion must match",
+			cohort:     Cohort{CIDRs: []string{"10.0.0.0/8"}, Zones: []string{"zone-a"}},
+			remoteAddr: "10.0.0.1:1",
+			headers:    map[string]string{"X-Client-Zone": "zone-b"},
+		},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		if tt.remoteAddr != "" {
+			r.RemoteAddr = tt.remoteAddr
+		}
+		for name, value := range tt.headers {
+			r.Header.Set(name, value)
+		}
+		if got := tt.cohort.matches(r); got != tt.want {
+			t.Errorf("%s: got %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCohortValidate(t *testing.T) {
+	tests := []struct {
+		cohort       Cohort
+		wantProblems int
+	}{
+		{Cohort{CIDRs: []string{"10.0.0.0/8", "::1"}, Header: "X-Plan", Values: []string{"free"}, Percent: 10, UserIDHeader: "X-Account"}, 0},
+		{Cohort{CIDRs: []string{"10.0.0.0/33", "nowhere"}}, 2},
+		{Cohort{Values: []string{"free"}}, 1},
+		{Cohort{Percent: 101}, 1},
+		{Cohort{Percent: -1}, 1},
+		{Cohort{UserIDHeader: "X-Account"}, 1},
+	}
+	for _, tt := range tests {
+		if problems := tt.cohort.validate("cohort"); len(problems) != tt.wantProblems {
+			t.Errorf("%+v: got problems %q, want %d", tt.cohort, problems, tt.wantProblems)
+		}
+	}
+}
+
+func TestParseCIDR(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    string
+		wantErr bool
+	}{
+		{s: "10.0.0.0/8", want: "10.0.0.0/8"},
+		{s: "10.1.2.3/16", want: "10.1.0.0/16"},
+		{s: "10.1.2.3", want: "10.1.2.3/32"},
+		{s: "fd00::1", want: "fd00::1/128"},
+		{s: "fd00::/8", want: "fd00::/8"},
+		{s: "10.0.0.0/33", wantErr: true},
+		{s: "10.0.0", wantErr: true},
+		{s: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseCIDR(tt.s)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: error %v, want error: %t", tt.s, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && got.String() != tt.want {
+			t.Errorf("%q: got %s, want %s", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestUserBucket(t *testing.T) {
+	if a, b := userBucket("alice"), userBucket("alice"); a != b {
+		t.Errorf("the same user got buckets %d and %d", a, b)
+	}
+	const users = 10000
+	below := 0
+	for i := 0; i < users; i++ {
+		bucket := userBucket(fmt.Sprintf("user-%d", i))
+		if bucket >= 10000 {
+			t.Fatalf("bucket %d out of range", bucket)
+		}
+		if bucket < 2500 {
+			below++
+		}
+	}
+	if below < 2200 || below > 2800 {
+		t.Errorf("%d of %d users fell in a 25%% cohort", below, users)
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	faultCompressionLie     = "compression_lie"
+	faultCompressionCorrupt = "compression_corrupt"
+	faultCompressionBomb    = "compression_bomb"
+
+	defaultBombSize = 1 << 30
+	maxBombSize     = 4 << 30
+)
+
+var errRequestTooLarge = errors.New("request body too large")
+
+// Compression lists the response encodings failserver offers, in order of
+// preference. Responses are not compressed when it is unset.
+type Compression struct {
+	Encodings []string `json:"encodings"`
+}
+
+func (c *Compression) validate(prefix string) []string {
+	var problems []string
+	for _, encoding := range c.Encodings {
+		encoder, err := newEncoder(encoding, ioutil.Discard)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", prefix, err))
+			continue
+		}
+		encoder.Close()
+	}
+	return problems
+}
+
+func newEncoder(encoding string, w io.Writer) (io.WriteCloser, error) {
+	switch encoding {
+	case "gzip":
+		return gzip.NewWriter(w), nil
+	case "br":
+		return brotli.NewWriter(w), nil
+	case "zstd":
+		return zstd.NewWriter(w)
+	}
+	return nil, fmt.Errorf("unsupported encoding %q", encoding)
+}
+
+func newDecoder(encoding string, r io.Reader) (io.ReadCloser, error) {
+	switch encoding {
+	case "gzip":
+		return gzip.NewReader(r)
+	case "br":
+		return ioutil.NopCloser(brotli.NewReader(r)), nil
+	case "zstd":
+		decoder, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	}
+	return nil, fmt.Errorf("unsupported encoding %q", encoding)
+}
+
+func compress(encoding string, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder, err := newEncoder(encoding, &buf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := encoder.Write(data); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// negotiateEncoding returns the first of the offered encodings the client
+// accepts with a non-zero quality, or "" for no encoding. An encoding the
+// client lists explicitly is not accepted through "*".
+func negotiateEncoding(acceptEncoding string, offered []string) string {
+	qualities := map[string]float64{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		if name == "" {
+			continue
+		}
+		quality := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					quality = q
+				}
+			}
+		}
+		qualities[name] = quality
+	}
+
+	for _, encoding := range offered {
+		quality, ok := qualities[encoding]
+		if !ok {
+			quality = qualities["*"]
+		}
+		if quality > 0 {
+			return encoding
+		}
+	}
+	return ""
+}
+
+// readRequestBody reads the whole request body, decompressing it according
+// to its Content-Encoding. Bodies decoding to more than max bytes are
+// rejected with errRequestTooLarge.
+func readRequestBody(r *http.Request, max int64) ([]byte, error) {
+	var body io.Reader = r.Body
+	if encoding := r.Header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		decoder, err := newDecoder(encoding, r.Body)
+		if err != nil {
+			return nil, err
+		}
+		defer decoder.Close()
+		body = decoder
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(body, max+1))
+	if err == nil && int64(len(data)) > max {
+		return nil, errRequestTooLarge
+	}
+	return data, err
+}
+
+// bomb is a compression bomb of one size, built once.
+type bomb struct {
+	once sync.Once
+	data []byte
+	err  error
+}
+
+var (
+	bombLock sync.Mutex
+	bombs    = map[int64]*bomb{}
+)
+
+// compressionBomb returns a small gzip stream that expands to size zero bytes.
+// Bombs are built once per size since compressing a gigabyte takes a while,
+// usually by prepareBombs before any request asks for them.
+func compressionBomb(size int64) ([]byte, error) {
+	if size > maxBombSize {
+		return nil, fmt.Errorf("bomb size %d is above the maximum of %d", size, int64(maxBombSize))
+	}
+	bombLock.Lock()
+	b, ok := bombs[size]
+	if !ok {
+		b = &bomb{}
+		bombs[size] = b
+	}
+	bombLock.Unlock()
+
+	b.once.Do(func() {
+		b.data, b.err = buildBomb(size)
+	})
+	return b.data, b.err
+}
+
+func buildBomb(size int64) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	zeros := make([]byte, 1<<20)
+	for written := int64(0); written < size; written += int64(len(zeros)) {
+		chunk := zeros
+		if remaining := size - written; remaining < int64(len(chunk)) {
+			chunk = chunk[:remaining]
+		}
+		if _, err := encoder.Write(chunk); err != nil {
+			return nil, err
+		}
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// prepareBombs builds the bombs cfg's rules send, outside of any request, and
+// forgets those no rule uses anymore.
+func prepareBombs(cfg Config) {
+	sizes := map[int64]bool{}
+	for _, rule := range cfg.Rules {
+		if rule.Type == faultCompressionBomb {
+			size := rule.Size
+			if size == 0 {
+				size = defaultBombSize
+			}
+			sizes[size] = true
+		}
+	}
+
+	bombLock.Lock()
+	for size := range bombs {
+		if !sizes[size] {
+			delete(bombs, size)
+		}
+	}
+	bombLock.Unlock()
+
+	for size := range sizes {
+		if _, err := compressionBomb(size); err != nil {
+			log.Printf("Failed to build a %d byte compression bomb: %s\n", size, err)
+		}
+	}
+}
+
+// writeBody sends a successful response body, compressed as negotiated or
+// mangled by the first compression fault that triggers.
+func writeBody(w http.ResponseWriter, r *http.Request, cfg Config, body []byte) error {
+	var offered []string
+	if cfg.Compression != nil {
+		offered = cfg.Compression.Encodings
+	}
+	encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"), offered)
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	for _, rule := range cfg.Rules {
+		switch rule.Type {
+		case faultCompressionLie, faultCompressionCorrupt, faultCompressionBomb:
+		default:
+			continue
+		}
+		if !rule.triggers(r) {
+			continue
+		}
+		injectFault(rule)
+
+		faultEncoding := encoding
+		if faultEncoding == "" {
+			faultEncoding = "gzip"
+		}
+		switch rule.Type {
+		case faultCompressionLie:
+			w.Header().Set("Content-Encoding", faultEncoding)
+		case faultCompressionCorrupt:
+			compressed, err := compress(faultEncoding, body)
+			if err != nil {
+				return err
+			}
+			body = corrupt(compressed)
+			w.Header().Set("Content-Encoding", faultEncoding)
+		case faultCompressionBomb:
+			size := rule.Size
+			if size == 0 {
+				size = defaultBombSize
+			}
+			bomb, err := compressionBomb(size)
+			if err != nil {
+				return err
+			}
+			body = bomb
+			w.Header().Set("Content-Encoding", "gzip")
+		}
+		_, err := w.Write(body)
+		return err
+	}
+
+	if encoding != "" {
+		compressed, err := compress(encoding, body)
+		if err != nil {
+			return err
+		}
+		body = compressed
+		w.Header().Set("Content-Encoding", encoding)
+	}
+	_, err := w.Write(body)
+	return err
+}
+
+// corrupt flips bits in the second half of a compressed stream, leaving its
+// header intact so that clients only notice once they start decoding.
+func corrupt(data []byte) []byte {
+	out := make([]byte, len(data))
+	copy(out, data)
+	for i := len(out) / 2; i < len(out); i += 3 {
+		out[i] ^= 0x5a
+	}
+	return out
+}
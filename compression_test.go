@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	offered := []string{"zstd", "br", "gzip"}
+	tests := []struct {
+		acceptEncoding string
+		offered        []string
+		want           string
+	}{
+		{"", offered, ""},
+		{"gzip", offered, "gzip"},
+		{"gzip, br", offered, "br"},
+		{"GZIP ; q=0.5", offered, "gzip"},
+		{"br;q=0, gzip", offered, "gzip"},
+		{"*", offered, "zstd"},
+		{"*;q=0", offered, ""},
+		{"gzip;q=0, *", []string{"gzip"}, ""},
+		{"zstd;q=0, br;q=0, *", offered, "gzip"},
+		{"*;q=0, gzip", offered, "gzip"},
+		{"identity", offered, ""},
+		{"gzip", nil, ""},
+		{"gzip;q=bad", offered, "gzip"},
+	}
+	for _, tt := range tests {
+		if got := negotiateEncoding(tt.acceptEncoding, tt.offered); got != tt.want {
+			t.Errorf("negotiateEncoding(%q, %q): got %q, want %q", tt.acceptEncoding, tt.offered, got, tt.want)
+		}
+	}
+}
+
+func TestCompressionBomb(t *testing.T) {
+	const size = 3<<20 + 5
+	bomb, err := compressionBomb(size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoder, err := gzip.NewReader(bytes.NewReader(bomb))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := io.Copy(ioutil.Discard, decoder)
+	if err != nil || n != size {
+		t.Errorf("bomb expands to %d bytes (%v), want %d", n, err, size)
+	}
+
+	if _, err := compressionBomb(maxBombSize + 1); err == nil {
+		t.Error("a bomb above the maximum size was built")
+	}
+
+	prepareBombs(Config{Rules: []Rule{{Type: faultCompressionBomb, Size: 1 << 20}}})
+	bombLock.Lock()
+	defer bombLock.Unlock()
+	if _, ok := bombs[size]; ok {
+		t.Error("prepareBombs kept a bomb no rule uses")
+	}
+	if b, ok := bombs[1<<20]; !ok || b.data == nil {
+		t.Error("prepareBombs did not build the configured bomb")
+	}
+}
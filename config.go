@@ -0,0 +1,435 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	faultError     = "error"
+	faultLatency   = "latency"
+	faultRateLimit = "rate_limit"
+)
+
+// Duration is a time.Duration that reads and writes JSON as "250ms" style strings.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"250ms\", got %s", b)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+type Rule struct {
+	Name        string   `json:"name"`
+	Type        string   `json:"type"`
+	Disabled    bool     `json:"disabled,omitempty"`
+	Route       string   `json:"route,omitempty"`
+	Probability float64  `json:"probability"`
+	Status      int      `json:"status,omitempty"`
+	Message     string   `json:"message,omitempty"`
+	MaxLatency  Duration `json:"max_latency,omitempty"`
+	Every       int      `json:"every,omitempty"`
+	Limit       int      `json:"limit,omitempty"`
+	Window      Duration `json:"window,omitempty"`
+	Cohort      *Cohort  `json:"cohort,omitempty"`
+	Size        int64    `json:"size,omitempty"`
+	Skew        Duration `json:"skew,omitempty"`
+}
+
+type Config struct {
+	Rules        []Rule              `json:"rules"`
+	Incidents    []Incident          `json:"incidents,omitempty"`
+	LoadBalancer *LoadBalancerFaults `json:"load_balancer,omitempty"`
+	Compression  *Compression        `json:"compression,omitempty"`
+	CORS         *CORS               `json:"cors,omitempty"`
+}
+
+// errNotFound is returned by config updates that refer to something missing.
+type errNotFound string
+
+func (e errNotFound) Error() string {
+	return string(e)
+}
+
+func errorStatus(err error) int {
+	if _, ok := err.(errNotFound); ok {
+		return http.StatusNotFound
+	}
+	return http.StatusBadRequest
+}
+
+// configStamp orders configuration changes across a cluster: the highest
+// version wins and ties are broken by node ID.
+type configStamp struct {
+	Version int64  `json:"version"`
+	Node    string `json:"node"`
+}
+
+func (s configStamp) newerThan(other configStamp) bool {
+	if s.Version != other.Version {
+		return s.Version > other.Version
+	}
+	return s.Node > other.Node
+}
+
+var (
+	configLock    sync.RWMutex
+	config        Config
+	configVersion configStamp
+)
+
+func defaultConfig() Config {
+	cfg := Config{
+		Rules: []Rule{
+			{
+				Name:        "not-found",
+				Type:        faultError,
+				Probability: 0.01,
+				Status:      http.StatusNotFound,
+				Message:     "Could not find your lucky number!",
+			},
+			{
+				Name:        "internal-error",
+				Type:        faultError,
+				Probability: 0.01,
+				Status:      http.StatusInternalServerError,
+				Message:     "Failed to compute your lucky number!",
+			},
+		},
+	}
+	if settings.MaxLatency > 0 {
+		cfg.Rules = append(cfg.Rules, Rule{
+			Name:        "latency",
+			Type:        faultLatency,
+			Probability: 1,
+			MaxLatency:  settings.MaxLatency,
+		})
+	}
+	return cfg
+}
+
+func (rule Rule) matches(r *http.Request) bool {
+	if rule.Route != "" && !strings.HasPrefix(r.URL.Path, rule.Route) {
+		return false
+	}
+	return rule.Cohort == nil || rule.Cohort.matches(r)
+}
+
+func (rule Rule) fires() bool {
+	return rand.Float64() < rule.Probability
+}
+
+// triggers decides whether the rule injects its fault into r. Sequences,
+// budgets and rate limits are counted in the shared counters so that they
+// hold across every node of a cluster.
+func (rule Rule) triggers(r *http.Request) bool {
+	if rule.Disabled || !rule.matches(r) {
+		return false
+	}
+
+	current := time.Now()
+	window := time.Duration(rule.Window)
+	switch {
+	case rule.Type == faultRateLimit:
+		return counters.add(windowKey("requests:"+rule.Name, window, current), 1) > int64(rule.Limit)
+	case rule.Every > 0:
+		if counters.add("sequence:"+rule.Name, 1)%int64(rule.Every) != 0 {
+			return false
+		}
+	case !rule.fires():
+		return false
+	}
+
+	if rule.Limit > 0 {
+		key := windowKey("budget:"+rule.Name, window, current)
+		if counters.total(key) >= int64(rule.Limit) {
+			return false
+		}
+		counters.add(key, 1)
+	}
+	return true
+}
+
+func (rule Rule) routeLabel() string {
+	if rule.Route == "" {
+		return "*"
+	}
+	return rule.Route
+}
+
+func (cfg Config) validate() error {
+	var problems []string
+	names := map[string]bool{}
+	for i, rule := range cfg.Rules {
+		prefix := fmt.Sprintf("rules[%d]", i)
+		if rule.Name == "" {
+			problems = append(problems, prefix+": name is required")
+		} else if names[rule.Name] {
+			problems = append(problems, fmt.Sprintf("%s: duplicate rule name %q", prefix, rule.Name))
+		}
+		names[rule.Name] = true
+		if rule.Probability < 0 || rule.Probability > 1 {
+			problems = append(problems, fmt.Sprintf("%s: probability %v is outside [0, 1]", prefix, rule.Probability))
+		}
+		if rule.Route != "" && !strings.HasPrefix(rule.Route, "/") {
+			problems = append(problems, fmt.Sprintf("%s: route %q must start with /", prefix, rule.Route))
+		}
+		if rule.Cohort != nil {
+			problems = append(problems, rule.Cohort.validate(prefix+".cohort")...)
+		}
+		if rule.Every < 0 || rule.Limit < 0 || rule.Window < 0 {
+			problems = append(problems, prefix+": every, limit and window must not be negative")
+		}
+		switch rule.Type {
+		case faultError:
+			if rule.Status < 400 || rule.Status > 599 {
+				problems = append(problems, fmt.Sprintf("%s: status %d is not an HTTP error code", prefix, rule.Status))
+			}
+		case faultRateLimit:
+			if rule.Limit <= 0 || rule.Window <= 0 {
+				problems = append(problems, prefix+": rate_limit needs a positive limit and window")
+			}
+			if rule.Status != 0 && (rule.Status < 400 || rule.Status > 599) {
+				problems = append(problems, fmt.Sprintf("%s: status %d is not an HTTP error code", prefix, rule.Status))
+			}
+		case faultLatency:
+			if rule.MaxLatency <= 0 {
+				problems = append(problems, prefix+": max_latency must be positive")
+			}
+		case faultDateSkew, faultExpiresSkew, faultLastModifiedSkew:
+			if rule.Skew == 0 {
+				problems = append(problems, prefix+": skew is required")
+			}
+		case faultPreflightLatency:
+			if rule.MaxLatency <= 0 {
+				problems = append(problems, prefix+": max_latency must be positive")
+			}
+		case faultPreflightError:
+			if rule.Status != 0 && (rule.Status < 400 || rule.Status > 599) {
+				problems = append(problems, fmt.Sprintf("%s: status %d is not an HTTP error code", prefix, rule.Status))
+			}
+		case faultCompressionLie, faultCompressionCorrupt, faultCORSMissingOrigin:
+		case faultCompressionBomb:
+			if rule.Size < 0 || rule.Size > maxBombSize {
+				problems = append(problems, fmt.Sprintf("%s: size must be between 0 and %d", prefix, int64(maxBombSize)))
+			}
+		default:
+			problems = append(problems, fmt.Sprintf("%s: unknown type %q", prefix, rule.Type))
+		}
+	}
+	if cfg.CORS != nil {
+		problems = append(problems, cfg.CORS.validate("cors")...)
+	}
+	if cfg.Compression != nil {
+		problems = append(problems, cfg.Compression.validate("compression")...)
+	}
+	if cfg.LoadBalancer != nil {
+		problems = append(problems, cfg.LoadBalancer.validate("load_balancer")...)
+	}
+	incidentNames := map[string]bool{}
+	for i, inc := range cfg.Incidents {
+		prefix := fmt.Sprintf("incidents[%d]", i)
+		problems = append(problems, inc.validate(prefix)...)
+		if incidentNames[inc.Name] {
+			problems = append(problems, fmt.Sprintf("%s: duplicate incident name %q", prefix, inc.Name))
+		}
+		incidentNames[inc.Name] = true
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid config: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func currentConfig() Config {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	return config
+}
+
+func currentConfigStamp() (Config, configStamp) {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	return config, configVersion
+}
+
+// setConfig replaces the active configuration and records the change in the
+// audit log under the given source.
+func setConfig(cfg Config, source string) error {
+	_, err := updateConfig(source, func(current *Config) error {
+		*current = cfg
+		return nil
+	})
+	return err
+}
+
+// updateConfig applies update to a copy of the active configuration and makes
+// the result active if it is valid. The update must not modify the slices of
+// the configuration it is given in place.
+func updateConfig(source string, update func(cfg *Config) error) (Config, error) {
+	configLock.Lock()
+	cfg := config
+	if err := update(&cfg); err != nil {
+		configLock.Unlock()
+		return cfg, err
+	}
+	if err := cfg.validate(); err != nil {
+		configLock.Unlock()
+		return cfg, err
+	}
+	diff := diffConfigs(config, cfg)
+	if len(diff) > 0 {
+		config = cfg
+		configVersion = configStamp{Version: configVersion.Version + 1, Node: settings.NodeID}
+	}
+	configLock.Unlock()
+
+	if len(diff) > 0 {
+		recordAudit(source, diff)
+		go prepareBombs(cfg)
+	}
+	return cfg, nil
+}
+
+// mergeConfig applies a configuration received from another node if it is
+// newer than the active one.
+func mergeConfig(cfg Config, stamp configStamp, source string) error {
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+
+	configLock.Lock()
+	if !stamp.newerThan(configVersion) {
+		configLock.Unlock()
+		return nil
+	}
+	diff := diffConfigs(config, cfg)
+	config = cfg
+	configVersion = stamp
+	configLock.Unlock()
+
+	if len(diff) > 0 {
+		recordAudit(source, diff)
+		go prepareBombs(cfg)
+	}
+	return nil
+}
+
+// restoreConfig makes a previously saved configuration active regardless of
+// its stamp.
+func restoreConfig(cfg Config, stamp configStamp, source string) error {
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+
+	configLock.Lock()
+	diff := diffConfigs(config, cfg)
+	config = cfg
+	configVersion = stamp
+	configLock.Unlock()
+
+	if len(diff) > 0 {
+		recordAudit(source, diff)
+		go prepareBombs(cfg)
+	}
+	return nil
+}
+
+func diffConfigs(old, new Config) []string {
+	before, _ := json.MarshalIndent(old, "", "  ")
+	after, _ := json.MarshalIndent(new, "", "  ")
+	return diffLines(strings.Split(string(before), "\n"), strings.Split(string(after), "\n"))
+}
+
+// diffLines returns the lines removed from a ("- ") and added in b ("+ "),
+// in order, based on their longest common subsequence.
+func diffLines(a, b []string) []string {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var out []string
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			out = append(out, "- "+a[i])
+			i++
+		default:
+			out = append(out, "+ "+b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		out = append(out, "- "+a[i])
+	}
+	for ; j < len(b); j++ {
+		out = append(out, "+ "+b[j])
+	}
+	return out
+}
+
+func configHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, currentConfig())
+	case http.MethodPut, http.MethodPost:
+		var cfg Config
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&cfg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := setConfig(cfg, "admin:"+r.RemoteAddr); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, cfg)
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		log.Printf("Failed to write response: %s\n", err)
+	}
+}
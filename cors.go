@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	faultCORSMissingOrigin = "cors_missing_origin"
+	faultPreflightError    = "preflight_error"
+	faultPreflightLatency  = "preflight_latency"
+)
+
+// CORS controls which browser origins may call failserver. Requests from
+// other origins are answered without Access-Control-Allow-Origin.
+type CORS struct {
+	AllowedOrigins   []string `json:"allowed_origins"`
+	AllowedMethods   []string `json:"allowed_methods,omitempty"`
+	AllowedHeaders   []string `json:"allowed_headers,omitempty"`
+	ExposedHeaders   []string `json:"exposed_headers,omitempty"`
+	AllowCredentials bool     `json:"allow_credentials,omitempty"`
+	MaxAge           Duration `json:"max_age,omitempty"`
+}
+
+func (c *CORS) validate(prefix string) []string {
+	var problems []string
+	if len(c.AllowedOrigins) == 0 {
+		problems = append(problems, prefix+": allowed_origins is required")
+	}
+	if c.AllowCredentials && containsFold(c.AllowedOrigins, "*") {
+		problems = append(problems, prefix+": allow_credentials cannot be used with the * origin")
+	}
+	if c.MaxAge < 0 {
+		problems = append(problems, prefix+": max_age must not be negative")
+	}
+	return problems
+}
+
+func (c *CORS) allows(origin string) bool {
+	return containsFold(c.AllowedOrigins, "*") || containsFold(c.AllowedOrigins, origin)
+}
+
+func (c *CORS) allowOrigin(w http.ResponseWriter, origin string) {
+	if containsFold(c.AllowedOrigins, "*") {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	} else {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+	}
+	if c.AllowCredentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+func isPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions &&
+		r.Header.Get("Origin") != "" &&
+		r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// applyCORS adds the CORS response headers for r and answers preflight
+// requests. It reports whether the request has been fully handled.
+func applyCORS(w http.ResponseWriter, r *http.Request, cfg Config) bool {
+	origin := r.Header.Get("Origin")
+	if cfg.CORS == nil || origin == "" {
+		return false
+	}
+	w.Header().Add("Vary", "Origin")
+
+	if !isPreflight(r) {
+		for _, rule := range cfg.Rules {
+			if rule.Type == faultCORSMissingOrigin && rule.triggers(r) {
+				injectFault(rule)
+				return false
+			}
+		}
+		if cfg.CORS.allows(origin) {
+			cfg.CORS.allowOrigin(w, origin)
+			if len(cfg.CORS.ExposedHeaders) > 0 {
+				w.Header().Set("Access-Control-Expose-Headers", strings.Join(cfg.CORS.ExposedHeaders, ", "))
+			}
+		}
+		return false
+	}
+
+	for _, rule := range cfg.Rules {
+		switch rule.Type {
+		case faultPreflightLatency:
+			if rule.triggers(r) {
+				simulateLatency(rule)
+			}
+		case faultPreflightError:
+			if rule.triggers(r) {
+				status, message := rule.Status, rule.Message
+				if status == 0 {
+					status = http.StatusInternalServerError
+				}
+				if message == "" {
+					message = "Preflight failed"
+				}
+				injectFault(rule)
+				httpRequests.With(statusCodeLabel(status)).Inc()
+				http.Error(w, message, status)
+				return true
+			}
+		}
+	}
+
+	if cfg.CORS.allows(origin) {
+		cfg.CORS.allowOrigin(w, origin)
+		methods := cfg.CORS.AllowedMethods
+		if len(methods) == 0 {
+			methods = []string{http.MethodGet, http.MethodHead, http.MethodPost}
+		}
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+		if len(cfg.CORS.AllowedHeaders) > 0 {
+			w.Header().Set("Access-Control-Allow-Headers", strings.Join(cfg.CORS.AllowedHeaders, ", "))
+		} else if requested := r.Header.Get("Access-Control-Request-Headers"); requested != "" {
+			w.Header().Set("Access-Control-Allow-Headers", requested)
+		}
+		if cfg.CORS.MaxAge > 0 {
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(time.Duration(cfg.CORS.MaxAge).Seconds())))
+		}
+	}
+	httpRequests.With(statusCodeLabel(http.StatusNoContent)).Inc()
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sharedCounters holds grow-only counters that can be merged between cluster
+// nodes. Each node only ever increments its own slot, so the value of a key is
+// the sum of all slots and merging keeps the highest count seen per node.
+// A reset starts a new epoch; counts from older epochs are ignored when
+// merging, so a reset on one node clears the counters of the whole cluster.
+type sharedCounters struct {
+	sync.Mutex
+	epoch  int64
+	counts map[string]map[string]int64
+}
+
+const counterRetention = time.Minute
+
+var counters = &sharedCounters{counts: map[string]map[string]int64{}}
+
+// add increments the local node's count for key and returns the total over
+// all known nodes.
+func (c *sharedCounters) add(key string, n int64) int64 {
+	c.Lock()
+	defer c.Unlock()
+	nodes := c.counts[key]
+	if nodes == nil {
+		nodes = map[string]int64{}
+		c.counts[key] = nodes
+	}
+	nodes[settings.NodeID] += n
+	return sumCounts(nodes)
+}
+
+func (c *sharedCounters) total(key string) int64 {
+	c.Lock()
+	defer c.Unlock()
+	return sumCounts(c.counts[key])
+}
+
+func (c *sharedCounters) merge(remote map[string]map[string]int64, epoch int64) {
+	c.Lock()
+	defer c.Unlock()
+	if epoch < c.epoch {
+		return
+	}
+	if epoch > c.epoch {
+		c.epoch = epoch
+		c.counts = map[string]map[string]int64{}
+	}
+	for key, remoteNodes := range remote {
+		nodes := c.counts[key]
+		if nodes == nil {
+			nodes = map[string]int64{}
+			c.counts[key] = nodes
+		}
+		for node, count := range remoteNodes {
+			if count > nodes[node] {
+				nodes[node] = count
+			}
+		}
+	}
+}
+
+func (c *sharedCounters) snapshot() (map[string]map[string]int64, int64) {
+	c.Lock()
+	defer c.Unlock()
+	out := make(map[string]map[string]int64, len(c.counts))
+	for key, nodes := range c.counts {
+		copied := make(map[string]int64, len(nodes))
+		for node, count := range nodes {
+			copied[node] = count
+		}
+		out[key] = copied
+	}
+	return out, c.epoch
+}
+
+// prune drops windowed counters whose window ended before the given time.
+func (c *sharedCounters) prune(before time.Time) {
+	c.Lock()
+	defer c.Unlock()
+	for key := range c.counts {
+		i := strings.LastIndex(key, "@")
+		if i < 0 {
+			continue
+		}
+		end, err := strconv.ParseInt(key[i+1:], 10, 64)
+		if err == nil && end < before.Unix() {
+			delete(c.counts, key)
+		}
+	}
+}
+
+// reset clears the counters and starts a new epoch, later than any seen.
+func (c *sharedCounters) reset(at time.Time) {
+	c.Lock()
+	defer c.Unlock()
+	c.epoch++
+	if epoch := at.UnixNano(); epoch > c.epoch {
+		c.epoch = epoch
+	}
+	c.counts = map[string]map[string]int64{}
+}
+
+func (c *sharedCounters) pruneExpired() {
+	for range time.Tick(counterRetention) {
+		c.prune(time.Now().Add(-counterRetention))
+	}
+}
+
+func sumCounts(nodes map[string]int64) int64 {
+	var total int64
+	for _, count := range nodes {
+		total += count
+	}
+	return total
+}
+
+// windowKey names a counter that only covers the fixed window of the given
+// length that at falls in. The key carries the end of the window so it can be
+// pruned.
+func windowKey(name string, window time.Duration, at time.Time) string {
+	if window <= 0 {
+		return name
+	}
+	end := at.Truncate(window).Add(window)
+	return fmt.Sprintf("%s@%d", name, end.Unix())
+}
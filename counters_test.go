@@ -0,0 +1,114 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSharedCountersMerge(t *testing.T) {
+	tests := []struct {
+		name   string
+		local  map[string]map[string]int64
+		epoch  int64
+		remote map[string]map[string]int64
+		remEp  int64
+		want   map[string]map[string]int64
+		wantEp int64
+	}{
+		{
+			name:   "keeps the highest count per node",
+			local:  map[string]map[string]int64{"k": {"a": 5, "b": 1}},
+			remote: map[string]map[string]int64{"k": {"a": 3, "b": 4, "c": 2}},
+			want:   map[string]map[string]int64{"k": {"a": 5, "b": 4, "c": 2}},
+		},
+		{
+			name:   "adds unknown keys",
+			local:  map[string]map[string]int64{"k": {"a": 1}},
+			remote: map[string]map[string]int64{"other": {"b": 7}},
+			want:   map[string]map[string]int64{"k": {"a": 1}, "other": {"b": 7}},
+		},
+		{
+			name:   "ignores counts from before a reset",
+			local:  map[string]map[string]int64{"k": {"a": 1}},
+			epoch:  10,
+			remote: map[string]map[string]int64{"k": {"a": 9, "b": 9}},
+			remEp:  5,
+			want:   map[string]map[string]int64{"k": {"a": 1}},
+			wantEp: 10,
+		},
+		{
+			name:   "adopts a newer reset",
+			local:  map[string]map[string]int64{"k": {"a": 9}, "old": {"a": 3}},
+			epoch:  5,
+			remote: map[string]map[string]int64{"k": {"b": 1}},
+			remEp:  10,
+			want:   map[string]map[string]int64{"k": {"b": 1}},
+			wantEp: 10,
+		},
+	}
+	for _, tt := range tests {
+		c := &sharedCounters{counts: tt.local, epoch: tt.epoch}
+		c.merge(tt.remote, tt.remEp)
+		got, epoch := c.snapshot()
+		if !reflect.DeepEqual(got, tt.want) || epoch != tt.wantEp {
+			t.Errorf("%s: got %v at epoch %d, want %v at epoch %d", tt.name, got, epoch, tt.want, tt.wantEp)
+		}
+	}
+}
+
+func TestSharedCountersAddAndReset(t *testing.T) {
+	settings.NodeID = "a"
+	c := &sharedCounters{counts: map[string]map[string]int64{}}
+	c.merge(map[string]map[string]int64{"k": {"b": 4}}, 0)
+	if got := c.add("k", 2); got != 6 {
+		t.Errorf("add: got %d, want 6", got)
+	}
+	if got := c.total("k"); got != 6 {
+		t.Errorf("total: got %d, want 6", got)
+	}
+
+	c.reset(time.Unix(100, 0))
+	if got := c.total("k"); got != 0 {
+		t.Errorf("total after reset: got %d, want 0", got)
+	}
+	_, epoch := c.snapshot()
+	c.merge(map[string]map[string]int64{"k": {"b": 4}}, 0)
+	if got := c.total("k"); got != 0 {
+		t.Errorf("total after merging pre-reset counts: got %d, want 0", got)
+	}
+
+	// a reset never goes back to an earlier epoch, even with a clock behind
+	c.reset(time.Unix(1, 0))
+	if _, later := c.snapshot(); later <= epoch {
+		t.Errorf("epoch after second reset: got %d, want more than %d", later, epoch)
+	}
+}
+
+func TestWindowKeyAndPrune(t *testing.T) {
+	at := time.Unix(125, 0)
+	tests := []struct {
+		window time.Duration
+		want   string
+	}{
+		{0, "requests"},
+		{time.Minute, "requests@180"},
+		{10 * time.Second, "requests@130"},
+	}
+	for _, tt := range tests {
+		if got := windowKey("requests", tt.window, at); got != tt.want {
+			t.Errorf("windowKey(%s): got %q, want %q", tt.window, got, tt.want)
+		}
+	}
+
+	c := &sharedCounters{counts: map[string]map[string]int64{
+		"requests":     {"a": 1},
+		"requests@130": {"a": 1},
+		"requests@180": {"a": 1},
+	}}
+	c.prune(time.Unix(150, 0))
+	got, _ := c.snapshot()
+	if _, ok := got["requests@130"]; ok || len(got) != 2 {
+		t.Errorf("prune kept %v", got)
+	}
+}
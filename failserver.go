@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -9,8 +10,9 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
-	"strconv"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -29,20 +31,55 @@ var (
 		},
 		[]string{"code"},
 	)
-	maxLatency = int64(getIntEnv("MAX_LATENCY_MS"))
-	version    = strings.TrimSpace(runCommand(exec.Command("git", "rev-parse", "HEAD")))
+	faultsInjected = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "failserver_faults_injected_total",
+			Help: "Number of faults injected by failserver",
+		},
+		[]string{"type", "rule", "route"},
+	)
+	injectedLatency = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "failserver_injected_latency_seconds",
+			Help:    "Latency injected into HTTP requests",
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+		},
+	)
+	settings       Settings
+	settingSources map[string]string
+	version        = strings.TrimSpace(runCommand(exec.Command("git", "rev-parse", "HEAD")))
 )
 
-func getIntEnv(envKey string) int {
-	envStr := os.Getenv(envKey)
-	i, _ := strconv.Atoi(envStr)
-	return i
+func injectFault(rule Rule) {
+	faultsInjected.With(prometheus.Labels{
+		"type":  rule.Type,
+		"rule":  rule.Name,
+		"route": rule.routeLabel(),
+	}).Inc()
 }
 
-func simulateLatency() {
-	if maxLatency > 0 {
-		time.Sleep(time.Duration(rand.Int63n(maxLatency)) * time.Millisecond)
+func injectError(w http.ResponseWriter, rule Rule) {
+	status, message := rule.Status, rule.Message
+	if rule.Type == faultRateLimit {
+		if status == 0 {
+			status = http.StatusTooManyRequests
+		}
+		if message == "" {
+			message = "Too many lucky numbers, slow down!"
+		}
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", int(time.Duration(rule.Window).Seconds())))
 	}
+
+	injectFault(rule)
+	httpRequests.With(statusCodeLabel(status)).Inc()
+	http.Error(w, message, status)
+}
+
+func simulateLatency(rule Rule) {
+	latency := time.Duration(rand.Int63n(int64(rule.MaxLatency)))
+	injectFault(rule)
+	injectedLatency.Observe(latency.Seconds())
+	time.Sleep(latency)
 }
 
 func statusCodeLabel(status int) prometheus.Labels {
@@ -67,18 +104,44 @@ func runCommand(cmd *exec.Cmd) string {
 func handler(w http.ResponseWriter, r *http.Request) {
 	now := time.Now()
 	defer requestDurationTrack(now)
-	simulateLatency()
-
-	switch n := rand.Intn(100); n {
-	case 4:
-		httpRequests.With(statusCodeLabel(http.StatusNotFound)).Inc()
-		http.Error(w, "Could not find your lucky number!", http.StatusNotFound)
-	case 5:
-		httpRequests.With(statusCodeLabel(http.StatusInternalServerError)).Inc()
-		http.Error(w, "Failed to compute your lucky number!", http.StatusInternalServerError)
-	default:
-		httpRequests.With(statusCodeLabel(http.StatusOK)).Inc()
-		fmt.Fprintf(w, "Your lucky number is %d", n)
+	cfg := currentConfig()
+	if settings.Zone != "" {
+		w.Header().Set("X-Server-Zone", settings.Zone)
+	}
+	applyClockHeaders(w, r, cfg)
+	if applyCORS(w, r, cfg) {
+		return
+	}
+	if applyIncidents(w, r, cfg.Incidents) {
+		return
+	}
+	if _, err := readRequestBody(r, settings.MaxRequestBody); err != nil {
+		status := http.StatusBadRequest
+		if err == errRequestTooLarge {
+			status = http.StatusRequestEntityTooLarge
+		}
+		httpRequests.With(statusCodeLabel(status)).Inc()
+		http.Error(w, "Could not decode your request: "+err.Error(), status)
+		return
+	}
+
+	for _, rule := range cfg.Rules {
+		if rule.Type == faultLatency && rule.triggers(r) {
+			simulateLatency(rule)
+		}
+	}
+
+	for _, rule := range cfg.Rules {
+		if (rule.Type == faultError || rule.Type == faultRateLimit) && rule.triggers(r) {
+			injectError(w, rule)
+			return
+		}
+	}
+
+	httpRequests.With(statusCodeLabel(http.StatusOK)).Inc()
+	body := fmt.Sprintf("Your lucky number is %d", rand.Intn(100))
+	if err := writeBody(w, r, cfg, []byte(body)); err != nil {
+		log.Printf("Failed to write response: %s\n", err)
 	}
 }
 
@@ -86,11 +149,105 @@ func versionHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, version)
 }
 
+// stopOnSignal shuts down on SIGINT or SIGTERM. The cluster is closed first
+// so that no other replica changes the state after it was saved.
+func stopOnSignal(c *cluster, store *stateStore) {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-stop
+	log.Printf("Received %s, shutting down\n", sig)
+	if c != nil {
+		c.close()
+	}
+	if store != nil {
+		log.Printf("Saving state to %s\n", store.path)
+		if err := store.save(); err != nil {
+			log.Printf("Failed to save state to %s: %s\n", store.path, err)
+		}
+	}
+	os.Exit(0)
+}
+
 func main() {
-	prometheus.MustRegister(httpRequests, requestDuration)
+	var err error
+	settings, settingSources, err = loadSettings(os.Args[1:], os.Environ())
+	if err == flag.ErrHelp {
+		os.Exit(2)
+	} else if err != nil {
+		log.Fatal(err)
+	}
 
-	http.HandleFunc("/", handler)
+	prometheus.MustRegister(httpRequests, requestDuration, faultsInjected, injectedLatency,
+		configReloadSuccess, configReloadTimestamp, clusterMembers, clusterPeerUp, instanceInfo,
+		lbBackendUp, lbRequests, lbEjections)
+	instanceInfo.With(prometheus.Labels{"node": settings.NodeID, "zone": settings.Zone, "region": settings.Region}).Set(1)
+
+	if settings.AuditLogFile != "" {
+		if err := openAuditLog(settings.AuditLogFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var watcher *configWatcher
+	if settings.ConfigFile != "" {
+		watcher = &configWatcher{path: settings.ConfigFile, interval: time.Duration(settings.ReloadInterval)}
+	}
+	var store *stateStore
+	restored := false
+	if settings.StateFile != "" {
+		store = &stateStore{path: settings.StateFile, watcher: watcher}
+		if restored, err = store.restore(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if !restored {
+		if err := setConfig(defaultConfig(), "startup"); err != nil {
+			log.Fatal(err)
+		}
+	}
+	// A restored state remembers which config file content it already saw,
+	// so only a file edited while failserver was down overrides it.
+	if watcher != nil {
+		if err := watcher.reload(false); err != nil {
+			log.Fatal(err)
+		}
+		go watcher.watch()
+	}
+	if store != nil {
+		go store.run()
+	}
+
+	go counters.pruneExpired()
+	var c *cluster
+	if settings.ClusterAddr != "" {
+		c = newCluster(settings.ClusterAddr, settings.ClusterPeers)
+		if err := c.listen(); err != nil {
+			log.Fatal(err)
+		}
+		go c.run()
+	}
+	go stopOnSignal(c, store)
+
+	if len(settings.LBBackends) > 0 {
+		lb, err := newLoadBalancer(settings)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go lb.runHealthChecks()
+		http.Handle("/", lb)
+	} else {
+		http.HandleFunc("/", handler)
+	}
 	http.HandleFunc("/version", versionHandler)
+	http.HandleFunc("/config", effectiveConfigHandler)
+	http.HandleFunc("/token", tokenHandler)
+	http.HandleFunc("/admin/config", configHandler)
+	http.HandleFunc("/admin/audit", auditHandler)
+	http.HandleFunc("/admin/incidents", incidentsHandler)
+	http.HandleFunc("/admin/rules", rulesHandler)
+	http.HandleFunc("/admin/schedules", schedulesHandler)
+	http.HandleFunc("/admin/reset", resetHandler)
+	http.Handle("/admin/", uiHandler())
 	http.Handle("/metrics", promhttp.Handler())
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	log.Fatal(http.ListenAndServe(settings.ListenAddr, nil))
 }
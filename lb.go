@@ -0,0 +1,337 @@
+package main
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"hash/fnv"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	lbRoundRobin     = "round_robin"
+	lbLeastConn      = "least_conn"
+	lbConsistentHash = "consistent_hash"
+
+	ringReplicas = 100
+)
+
+var (
+	lbBackendUp = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "failserver_lb_backend_up",
+			Help: "Whether a backend is currently receiving traffic",
+		},
+		[]string{"backend"},
+	)
+	lbRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "failserver_lb_requests_total",
+			Help: "Number of requests forwarded to each backend",
+		},
+		[]string{"backend", "code"},
+	)
+	lbEjections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "failserver_lb_ejections_total",
+			Help: "Number of times a backend was ejected as an outlier",
+		},
+		[]string{"backend"},
+	)
+)
+
+// LoadBalancerFaults change how the load balancer itself misbehaves.
+type LoadBalancerFaults struct {
+	HealthCheckLies float64        `json:"health_check_lies,omitempty"`
+	EjectionDelay   Duration       `json:"ejection_delay,omitempty"`
+	Weights         map[string]int `json:"weights,omitempty"`
+}
+
+func (f *LoadBalancerFaults) validate(prefix string) []string {
+	var problems []string
+	if f.HealthCheckLies < 0 || f.HealthCheckLies > 1 {
+		problems = append(problems, fmt.Sprintf("%s: health_check_lies %v is outside [0, 1]", prefix, f.HealthCheckLies))
+	}
+	if f.EjectionDelay < 0 {
+		problems = append(problems, prefix+": ejection_delay must not be negative")
+	}
+	for backend, weight := range f.Weights {
+		if weight < 0 {
+			problems = append(problems, fmt.Sprintf("%s: weight of %s must not be negative", prefix, backend))
+		}
+	}
+	return problems
+}
+
+func lbFaults() LoadBalancerFaults {
+	if lb := currentConfig().LoadBalancer; lb != nil {
+		return *lb
+	}
+	return LoadBalancerFaults{}
+}
+
+type backend struct {
+	url    *url.URL
+	name   string
+	proxy  *httputil.ReverseProxy
+	active int64
+
+	lock         sync.Mutex
+	healthy      bool
+	ejectedUntil time.Time
+	failures     int
+}
+
+func (b *backend) available(now time.Time) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.healthy && !now.Before(b.ejectedUntil)
+}
+
+func (b *backend) weight(weights map[string]int) int {
+	if weight, ok := weights[b.name]; ok {
+		return weight
+	}
+	return 1
+}
+
+// loadBalancer forwards requests to a pool of backends, checks their health
+// and ejects the ones that keep failing.
+type loadBalancer struct {
+	backends  []*backend
+	algorithm string
+	hashKey   string
+	next      uint64
+
+	ringLock sync.Mutex
+	ring     *hashRing
+}
+
+func newLoadBalancer(s Settings) (*loadBalancer, error) {
+	lb := &loadBalancer{algorithm: s.LBAlgorithm, hashKey: s.LBHashHeader}
+	for _, raw := range s.LBBackends {
+		u, err := url.Parse(raw)
+		if err != nil {
+			return nil, err
+		}
+		b := &backend{url: u, name: raw, healthy: true}
+		b.proxy = httputil.NewSingleHostReverseProxy(u)
+		b.proxy.ModifyResponse = func(b *backend) func(*http.Response) error {
+			return func(resp *http.Response) error {
+				lbRequests.With(prometheus.Labels{"backend": b.name, "code": strconv.Itoa(resp.StatusCode)}).Inc()
+				lb.observe(b, resp.StatusCode < 500)
+				return nil
+			}
+		}(b)
+		b.proxy.ErrorHandler = func(b *backend) func(http.ResponseWriter, *http.Request, error) {
+			return func(w http.ResponseWriter, r *http.Request, err error) {
+				log.Printf("Backend %s failed: %s\n", b.name, err)
+				lbRequests.With(prometheus.Labels{"backend": b.name, "code": "error"}).Inc()
+				lb.observe(b, false)
+				http.Error(w, "Bad gateway", http.StatusBadGateway)
+			}
+		}(b)
+		lb.backends = append(lb.backends, b)
+		lbBackendUp.With(prometheus.Labels{"backend": b.name}).Set(1)
+	}
+	return lb, nil
+}
+
+// observe feeds the outcome of a proxied request into outlier detection.
+func (lb *loadBalancer) observe(b *backend, ok bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if ok {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures < settings.LBEjectAfter {
+		return
+	}
+	b.failures = 0
+
+	eject := func() {
+		b.lock.Lock()
+		b.ejectedUntil = time.Now().Add(time.Duration(settings.LBEjectionTime))
+		b.lock.Unlock()
+		lbEjections.With(prometheus.Labels{"backend": b.name}).Inc()
+		lbBackendUp.With(prometheus.Labels{"backend": b.name}).Set(0)
+		log.Printf("Ejected backend %s\n", b.name)
+	}
+	if delay := time.Duration(lbFaults().EjectionDelay); delay > 0 {
+		time.AfterFunc(delay, eject)
+	} else {
+		go eject()
+	}
+}
+
+func (lb *loadBalancer) checkHealth(client *http.Client, b *backend) {
+	healthy := false
+	resp, err := client.Get(b.url.String() + settings.LBHealthPath)
+	if err == nil {
+		resp.Body.Close()
+		healthy = resp.StatusCode < 400
+	}
+	if rand.Float64() < lbFaults().HealthCheckLies {
+		healthy = !healthy
+	}
+
+	b.lock.Lock()
+	b.healthy = healthy
+	if healthy && !time.Now().Before(b.ejectedUntil) {
+		b.failures = 0
+	}
+	b.lock.Unlock()
+
+	up := 0.0
+	if b.available(time.Now()) {
+		up = 1
+	}
+	lbBackendUp.With(prometheus.Labels{"backend": b.name}).Set(up)
+}
+
+func (lb *loadBalancer) runHealthChecks() {
+	interval := time.Duration(settings.LBHealthInterval)
+	client := &http.Client{Timeout: interval}
+	for range time.Tick(interval) {
+		for _, b := range lb.backends {
+			go lb.checkHealth(client, b)
+		}
+	}
+}
+
+func (lb *loadBalancer) pick(r *http.Request) *backend {
+	now := time.Now()
+	weights := lbFaults().Weights
+	var candidates []*backend
+	for _, b := range lb.backends {
+		if b.available(now) && b.weight(weights) > 0 {
+			candidates = append(candidates, b)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	switch lb.algorithm {
+	case lbLeastConn:
+		best := candidates[0]
+		for _, b := range candidates[1:] {
+			if atomic.LoadInt64(&b.active)*int64(best.weight(weights)) < atomic.LoadInt64(&best.active)*int64(b.weight(weights)) {
+				best = b
+			}
+		}
+		return best
+	case lbConsistentHash:
+		return lb.hashRing(candidates, weights).lookup(lb.requestKey(r))
+	default:
+		total := 0
+		for _, b := range candidates {
+			total += b.weight(weights)
+		}
+		n := int(atomic.AddUint64(&lb.next, 1) % uint64(total))
+		for _, b := range candidates {
+			if n < b.weight(weights) {
+				return b
+			}
+			n -= b.weight(weights)
+		}
+		return candidates[0]
+	}
+}
+
+func (lb *loadBalancer) requestKey(r *http.Request) string {
+	if lb.hashKey != "" {
+		if key := r.Header.Get(lb.hashKey); key != "" {
+			return key
+		}
+	}
+	if ip := clientIP(r); ip != nil {
+		return ip.String()
+	}
+	return r.RemoteAddr
+}
+
+func hash32(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+type ringPoint struct {
+	hash    uint32
+	backend *backend
+}
+
+// hashRing places every candidate on a ring with a number of points
+// proportional to its weight. It is identified by the candidates and weights
+// it was built from.
+type hashRing struct {
+	id     string
+	points []ringPoint
+}
+
+func newHashRing(id string, candidates []*backend, weights map[string]int) *hashRing {
+	ring := &hashRing{id: id}
+	for _, b := range candidates {
+		for i := 0; i < ringReplicas*b.weight(weights); i++ {
+			ring.points = append(ring.points, ringPoint{hash32(b.name + "#" + strconv.Itoa(i)), b})
+		}
+	}
+	sort.Slice(ring.points, func(i, j int) bool { return ring.points[i].hash < ring.points[j].hash })
+	return ring
+}
+
+// lookup returns the first backend after the key.
+func (ring *hashRing) lookup(key string) *backend {
+	h := hash32(key)
+	i := sort.Search(len(ring.points), func(i int) bool { return ring.points[i].hash >= h })
+	if i == len(ring.points) {
+		i = 0
+	}
+	return ring.points[i].backend
+}
+
+// hashRing returns the ring for the candidates, rebuilding it only when they
+// or their weights changed since the last request.
+func (lb *loadBalancer) hashRing(candidates []*backend, weights map[string]int) *hashRing {
+	var id strings.Builder
+	for _, b := range candidates {
+		id.WriteString(b.name)
+		id.WriteByte('=')
+		id.WriteString(strconv.Itoa(b.weight(weights)))
+		id.WriteByte(' ')
+	}
+
+	lb.ringLock.Lock()
+	defer lb.ringLock.Unlock()
+	if lb.ring == nil || lb.ring.id != id.String() {
+		lb.ring = newHashRing(id.String(), candidates, weights)
+	}
+	return lb.ring
+}
+
+func (lb *loadBalancer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	defer requestDurationTrack(now)
+
+	b := lb.pick(r)
+	if b == nil {
+		httpRequests.With(statusCodeLabel(http.StatusServiceUnavailable)).Inc()
+		http.Error(w, "No healthy backends", http.StatusServiceUnavailable)
+		return
+	}
+	atomic.AddInt64(&b.active, 1)
+	defer atomic.AddInt64(&b.active, -1)
+	b.proxy.ServeHTTP(w, r)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// arrivalProcess draws the gap before the next arrivals, in units of the
+// mean gap at the current rate, and how many arrive together. The gaps
+// average 1 per arrival, so every process keeps the rate and only changes
+// how regular the arrivals are.
+type arrivalProcess func() (gap float64, batch int)
+
+// parseArrivalProcess reads constant, poisson, bursty[:size],
+// lognormal[:sigma], pareto[:alpha] or file:path, the latter drawing from
+// inter-arrival times observed elsewhere, one per line in any unit.
+func parseArrivalProcess(spec string) (arrivalProcess, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	param := func(alternative float64) (float64, error) {
+		if len(parts) < 2 {
+			return alternative, nil
+		}
+		return strconv.ParseFloat(parts[1], 64)
+	}
+
+	switch parts[0] {
+	case "constant":
+		return func() (float64, int) { return 1, 1 }, nil
+	case "poisson":
+		return func() (float64, int) { return rand.ExpFloat64(), 1 }, nil
+	case "bursty":
+		size, err := param(10)
+		if err != nil || size < 1 || size != math.Trunc(size) {
+			return nil, fmt.Errorf("bursty: the batch size must be a positive integer")
+		}
+		return func() (float64, int) { return rand.ExpFloat64() * size, int(size) }, nil
+	case "lognormal":
+		sigma, err := param(1)
+		if err != nil || sigma <= 0 {
+			return nil, fmt.Errorf("lognormal: sigma must be positive")
+		}
+		mu := -sigma * sigma / 2
+		return func() (float64, int) { return math.Exp(mu + sigma*rand.NormFloat64()), 1 }, nil
+	case "pareto":
+		alpha, err := param(1.5)
+		if err != nil || alpha <= 1 {
+			return nil, fmt.Errorf("pareto: alpha must be above 1 for the mean to exist")
+		}
+		scale := (alpha - 1) / alpha
+		return func() (float64, int) { return scale / math.Pow(1-rand.Float64(), 1/alpha), 1 }, nil
+	case "file":
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("file: no path given")
+		}
+		gaps, err := readGaps(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		return func() (float64, int) { return gaps[rand.Intn(len(gaps))], 1 }, nil
+	}
+	return nil, fmt.Errorf("unknown arrival process %q", spec)
+}
+
+// readGaps reads inter-arrival times and scales them to a mean of 1.
+func readGaps(path string) ([]float64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var gaps []float64
+	sum := 0.0
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		gap, err := strconv.ParseFloat(text, 64)
+		if err != nil || gap < 0 {
+			return nil, fmt.Errorf("%s: line %d: not an inter-arrival time", path, line)
+		}
+		gaps = append(gaps, gap)
+		sum += gap
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if sum == 0 {
+		return nil, fmt.Errorf("%s: no inter-arrival times", path)
+	}
+	for i := range gaps {
+		gaps[i] *= float64(len(gaps)) / sum
+	}
+	return gaps, nil
+}
+
+func constantRate(rps float64, duration time.Duration) rateCurve {
+	return rateCurve{steps: []rateStep{{0, rps}}, end: duration}
+}
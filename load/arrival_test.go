@@ -0,0 +1,117 @@
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseArrivalProcess(t *testing.T) {
+	dir, err := ioutil.TempDir("", "arrival")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	gaps := filepath.Join(dir, "gaps.txt")
+	if err := ioutil.WriteFile(gaps, []byte("# ms\n100\n\n300\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		spec      string
+		wantErr   bool
+		wantBatch int
+	}{
+		{spec: "constant", wantBatch: 1},
+		{spec: "poisson", wantBatch: 1},
+		{spec: "bursty", wantBatch: 10},
+		{spec: "bursty:3", wantBatch: 3},
+		{spec: "lognormal", wantBatch: 1},
+		{spec: "lognormal:0.5", wantBatch: 1},
+		{spec: "pareto", wantBatch: 1},
+		{spec: "pareto:3", wantBatch: 1},
+		{spec: "file:" + gaps, wantBatch: 1},
+		{spec: "bursty:2.5", wantErr: true},
+		{spec: "bursty:0", wantErr: true},
+		{spec: "bursty:x", wantErr: true},
+		{spec: "lognormal:0", wantErr: true},
+		{spec: "pareto:1", wantErr: true},
+		{spec: "file", wantErr: true},
+		{spec: "file:" + filepath.Join(dir, "missing"), wantErr: true},
+		{spec: "uniform", wantErr: true},
+	}
+	rand.Seed(1)
+	for _, tt := range tests {
+		process, err := parseArrivalProcess(tt.spec)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error %v, want error: %t", tt.spec, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		// gaps average 1 per arrival, whatever the process
+		const draws = 20000
+		var sum float64
+		arrivals := 0
+		for i := 0; i < draws; i++ {
+			gap, batch := process()
+			if gap < 0 || batch != tt.wantBatch {
+				t.Fatalf("%s: drew gap %g and batch %d", tt.spec, gap, batch)
+			}
+			sum += gap
+			arrivals += batch
+		}
+		if mean := sum / float64(arrivals); math.Abs(mean-1) > 0.1 {
+			t.Errorf("%s: mean gap per arrival %f, want 1", tt.spec, mean)
+		}
+	}
+}
+
+func TestReadGaps(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gaps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		data    string
+		want    []float64
+		wantErr bool
+	}{
+		{data: "1\n3\n", want: []float64{0.5, 1.5}},
+		{data: "# seconds\n 2 \n\n0\n4\n", want: []float64{1, 0, 2}},
+		{data: "1\nsoon\n", wantErr: true},
+		{data: "1\n-1\n", wantErr: true},
+		{data: "0\n0\n", wantErr: true},
+		{data: "# nothing\n", wantErr: true},
+	}
+	for i, tt := range tests {
+		path := filepath.Join(dir, string(rune('a'+i)))
+		if err := ioutil.WriteFile(path, []byte(tt.data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := readGaps(path)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: error %v, want error: %t", tt.data, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%q: got %v, want %v", tt.data, got, tt.want)
+			continue
+		}
+		for j := range got {
+			if math.Abs(got[j]-tt.want[j]) > 1e-9 {
+				t.Errorf("%q: got %v, want %v", tt.data, got, tt.want)
+				break
+			}
+		}
+	}
+}
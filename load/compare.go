@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+)
+
+// distribution is a latency histogram as counts per bucket. The last bucket
+// holds everything above the highest bound.
+type distribution struct {
+	bounds []float64
+	counts []float64
+	n      float64
+}
+
+func newDistribution(s snapshot) distribution {
+	d := distribution{bounds: s.BucketBounds, n: s.Count}
+	var previous float64
+	for _, cumulative := range s.BucketCounts {
+		d.counts = append(d.counts, cumulative-previous)
+		previous = cumulative
+	}
+	d.counts = append(d.counts, s.Count-previous)
+	return d
+}
+
+// quantile interpolates the q-quantile in microseconds from counts laid out
+// like d's.
+func (d distribution) quantile(counts []float64, q float64) float64 {
+	s := snapshot{BucketBounds: d.bounds}
+	var cumulative float64
+	for i, n := range counts {
+		cumulative += n
+		if i < len(d.bounds) {
+			s.BucketCounts = append(s.BucketCounts, cumulative)
+		}
+	}
+	s.Count = cumulative
+	return s.quantile(q)
+}
+
+// resample draws as many samples as d holds, with replacement, and returns their
+// counts per bucket. Each bucket's count is drawn from a binomial instead of
+// drawing every sample, so a resample costs the same for any number of
+// requests.
+func (d distribution) resample(rng *rand.Rand) []float64 {
+	counts := make([]float64, len(d.counts))
+	var total float64
+	for _, n := range d.counts {
+		total += n
+	}
+	remaining := int64(d.n)
+	for i, n := range d.counts {
+		if remaining <= 0 || total <= 0 {
+			break
+		}
+		drawn := binomial(rng, remaining, math.Min(1, n/total))
+		counts[i] = float64(drawn)
+		remaining -= drawn
+		total -= n
+	}
+	return counts
+}
+
+// binomial draws the number of successes in n trials of probability p. It
+// skips from one success to the next when they are rare and uses the normal
+// approximation when there are many.
+func binomial(rng *rand.Rand, n int64, p float64) int64 {
+	if p <= 0 || n <= 0 {
+		return 0
+	}
+	if p >= 1 {
+		return n
+	}
+	if p > 0.5 {
+		return n - binomial(rng, n, 1-p)
+	}
+	if mean := float64(n) * p; mean > 25 {
+		x := math.Round(mean + rng.NormFloat64()*math.Sqrt(mean*(1-p)))
+		return int64(math.Max(0, math.Min(float64(n), x)))
+	}
+	var successes, trial int64
+	logq := math.Log1p(-p)
+	for {
+		trial += int64(math.Log(1-rng.Float64())/logq) + 1
+		if trial > n {
+			return successes
+		}
+		successes++
+	}
+}
+
+type mannWhitneyResult struct {
+	U float64 `json:"u"`
+	Z float64 `json:"z"`
+	P float64 `json:"p"`
+	// ProbabilityOfSuperiority is the chance that a candidate request is
+	// slower than a baseline one, counting ties as half.
+	ProbabilityOfSuperiority float64 `json:"probability_of_superiority"`
+	// CliffsDelta is the effect size, from -1 (candidate always faster) to 1
+	// (candidate always slower).
+	CliffsDelta float64 `json:"cliffs_delta"`
+}
+
+// mannWhitney runs the Mann-Whitney U test with the normal approximation,
+// corrected for ties. All samples in a bucket are tied.
+func mannWhitney(a, b distribution) mannWhitneyResult {
+	n1, n2 := a.n, b.n
+	n := n1 + n2
+	var rankBase, rankSumB, ties float64
+	for i := range a.counts {
+		t := a.counts[i] + b.counts[i]
+		rankSumB += b.counts[i] * (rankBase + (t+1)/2)
+		ties += t*t*t - t
+		rankBase += t
+	}
+
+	u := rankSumB - n2*(n2+1)/2
+	mean := n1 * n2 / 2
+	variance := n1 * n2 / 12 * ((n + 1) - ties/(n*(n-1)))
+	r := mannWhitneyResult{U: u, P: 1}
+	if variance > 0 {
+		diff := u - mean
+		if diff > 0 {
+			diff = math.Max(diff-0.5, 0)
+		} else {
+			diff = math.Min(diff+0.5, 0)
+		}
+		r.Z = diff / math.Sqrt(variance)
+		r.P = math.Erfc(math.Abs(r.Z) / math.Sqrt2)
+	}
+	r.ProbabilityOfSuperiority = u / (n1 * n2)
+	r.CliffsDelta = 2*r.ProbabilityOfSuperiority - 1
+	return r
+}
+
+type ksResult struct {
+	D float64 `json:"d"`
+	P float64 `json:"p"`
+}
+
+// kolmogorovSmirnov runs the two sample Kolmogorov-Smirnov test. On bucketed
+// data D can only be underestimated, so the test is conservative.
+func kolmogorovSmirnov(a, b distribution) ksResult {
+	var cumA, cumB, d float64
+	for i := range a.counts {
+		cumA += a.counts[i]
+		cumB += b.counts[i]
+		d = math.Max(d, math.Abs(cumA/a.n-cumB/b.n))
+	}
+	ne := a.n * b.n / (a.n + b.n)
+	lambda := (math.Sqrt(ne) + 0.12 + 0.11/math.Sqrt(ne)) * d
+	return ksResult{D: d, P: ksProbability(lambda)}
+}
+
+func ksProbability(lambda float64) float64 {
+	if lambda < 0.2 {
+		return 1
+	}
+	var sum float64
+	sign := 1.0
+	for k := 1.0; k <= 100; k++ {
+		term := sign * 2 * math.Exp(-2*k*k*lambda*lambda)
+		sum += term
+		if math.Abs(term) < 1e-10 {
+			break
+		}
+		sign = -sign
+	}
+	return math.Max(0, math.Min(1, sum))
+}
+
+type percentileChange struct {
+	Quantile    float64 `json:"quantile"`
+	BaselineMs  float64 `json:"baseline_ms"`
+	CandidateMs float64 `json:"candidate_ms"`
+	DiffMs      float64 `json:"diff_ms"`
+	LowerMs     float64 `json:"ci_lower_ms"`
+	UpperMs     float64 `json:"ci_upper_ms"`
+	Significant bool    `json:"significant"`
+}
+
+// bootstrapChange estimates a confidence interval for the change of the
+// q-quantile by resampling both runs.
+func bootstrapChange(a, b distribution, q, confidence float64, iterations int, rng *rand.Rand) percentileChange {
+	c := percentileChange{
+		Quantile:    q,
+		BaselineMs:  a.quantile(a.counts, q) / 1000,
+		CandidateMs: b.quantile(b.counts, q) / 1000,
+	}
+	c.DiffMs = c.CandidateMs - c.BaselineMs
+
+	diffs := make([]float64, iterations)
+	for i := range diffs {
+		diffs[i] = (b.quantile(b.resample(rng), q) - a.quantile(a.resample(rng), q)) / 1000
+	}
+	sort.Float64s(diffs)
+	tail := (1 - confidence) / 2
+	c.LowerMs = diffs[int(tail*float64(iterations-1))]
+	c.UpperMs = diffs[int((1-tail)*float64(iterations-1)+0.5)]
+	c.Significant = c.LowerMs > 0 || c.UpperMs < 0
+	return c
+}
+
+type comparison struct {
+	Baseline            string             `json:"baseline"`
+	Candidate           string             `json:"candidate"`
+	BaselineRequests    float64            `json:"baseline_requests"`
+	CandidateRequests   float64            `json:"candidate_requests"`
+	Confidence          float64            `json:"confidence"`
+	MannWhitney         mannWhitneyResult  `json:"mann_whitney"`
+	KolmogorovSmirnov   ksResult           `json:"kolmogorov_smirnov"`
+	Percentiles         []percentileChange `json:"percentiles"`
+	DistributionsDiffer bool               `json:"distributions_differ"`
+}
+
+// readResultsFile reads the latency histogram from a METRICS_FILE.
+func readResultsFile(path string) (distribution, string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return distribution{}, "", err
+	}
+	var results struct {
+		Metadata *runMetadata        `json:"metadata"`
+		Metrics  []*dto.MetricFamily `json:"metrics"`
+	}
+	if err := json.Unmarshal(data, &results); err != nil {
+		// Files written before the metadata was added hold only the metrics
+		if err := json.Unmarshal(data, &results.Metrics); err != nil {
+			return distribution{}, "", fmt.Errorf("%s: %s", path, err)
+		}
+	}
+
+	s, err := takeSnapshot(prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		return results.Metrics, nil
+	}))
+	if err != nil {
+		return distribution{}, "", err
+	}
+	if s.Count == 0 {
+		return distribution{}, "", fmt.Errorf("%s: no latency samples", path)
+	}
+	name := path
+	if results.Metadata != nil {
+		name = fmt.Sprintf("%s (run %s, version %s)", path, results.Metadata.RunID, results.Metadata.TargetVersion)
+	}
+	return newDistribution(s), name, nil
+}
+
+func compareRuns(baselinePath, candidatePath string, confidence float64, iterations int, seed int64) (comparison, error) {
+	a, baselineName, err := readResultsFile(baselinePath)
+	if err != nil {
+		return comparison{}, err
+	}
+	b, candidateName, err := readResultsFile(candidatePath)
+	if err != nil {
+		return comparison{}, err
+	}
+	if fmt.Sprint(a.bounds) != fmt.Sprint(b.bounds) {
+		return comparison{}, fmt.Errorf("%s and %s use different histogram buckets", baselinePath, candidatePath)
+	}
+
+	c := comparison{
+		Baseline:          baselineName,
+		Candidate:         candidateName,
+		BaselineRequests:  a.n,
+		CandidateRequests: b.n,
+		Confidence:        confidence,
+		MannWhitney:       mannWhitney(a, b),
+		KolmogorovSmirnov: kolmogorovSmirnov(a, b),
+	}
+	alpha := 1 - confidence
+	c.DistributionsDiffer = c.MannWhitney.P < alpha || c.KolmogorovSmirnov.P < alpha
+	rng := rand.New(rand.NewSource(seed))
+	for _, q := range []float64{0.5, 0.9, 0.99} {
+		c.Percentiles = append(c.Percentiles, bootstrapChange(a, b, q, confidence, iterations, rng))
+	}
+	return c, nil
+}
+
+// runCompare implements the compare command. It exits with 1 when the
+// candidate's p99 is significantly higher than the baseline's.
+func runCompare(args []string) {
+	flags := flag.NewFlagSet("compare", flag.ExitOnError)
+	confidence := flags.Float64("confidence", 0.95, "confidence level of the tests and intervals")
+	iterations := flags.Int("bootstrap", 1000, "number of bootstrap resamples")
+	seed := flags.Int64("seed", 1, "seed of the bootstrap resampling")
+	asJson := flags.Bool("json", false, "print the comparison as JSON")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: load compare [flags] BASELINE_METRICS_FILE CANDIDATE_METRICS_FILE")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 2 || *confidence <= 0 || *confidence >= 1 || *iterations < 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	c, err := compareRuns(flags.Arg(0), flags.Arg(1), *confidence, *iterations, *seed)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	if *asJson {
+		bytes, _ := json.MarshalIndent(c, "", "  ")
+		fmt.Println(string(bytes))
+	} else {
+		printComparison(c)
+	}
+	for _, p := range c.Percentiles {
+		if p.Quantile == 0.99 && p.Significant && p.DiffMs > 0 {
+			os.Exit(1)
+		}
+	}
+}
+
+func printComparison(c comparison) {
+	fmt.Printf("Baseline:  %s, %.0f requests\n", c.Baseline, c.BaselineRequests)
+	fmt.Printf("Candidate: %s, %.0f requests\n\n", c.Candidate, c.CandidateRequests)
+	for _, p := range c.Percentiles {
+		verdict := "noise"
+		if p.Significant {
+			verdict = "significant"
+		}
+		fmt.Printf("p%-3g %8.1fms -> %8.1fms  %+8.1fms  %.0f%% CI [%+.1f, %+.1f]ms  %s\n",
+			p.Quantile*100, p.BaselineMs, p.CandidateMs, p.DiffMs, c.Confidence*100, p.LowerMs, p.UpperMs, verdict)
+	}
+	mw, ks := c.MannWhitney, c.KolmogorovSmirnov
+	fmt.Printf("\nMann-Whitney U: U=%.0f z=%.2f p=%.4g, P(candidate slower)=%.3f, Cliff's delta=%+.3f\n",
+		mw.U, mw.Z, mw.P, mw.ProbabilityOfSuperiority, mw.CliffsDelta)
+	fmt.Printf("Kolmogorov-Smirnov: D=%.4f p=%.4g\n", ks.D, ks.P)
+	if c.DistributionsDiffer {
+		fmt.Println("The latency distributions differ.")
+	} else {
+		fmt.Println("No significant difference between the latency distributions.")
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// bounds of 10ms buckets in microseconds, like the load tester's histogram
+var testBounds = []float64{10000, 20000, 30000, 40000}
+
+func testDistribution(counts ...float64) distribution {
+	d := distribution{bounds: testBounds, counts: counts}
+	for _, n := range counts {
+		d.n += n
+	}
+	return d
+}
+
+func TestMannWhitney(t *testing.T) {
+	tests := []struct {
+		name      string
+		a, b      distribution
+		wantDelta float64
+		wantLowP  bool
+	}{
+		{"same", testDistribution(10, 20, 30, 20, 10), testDistribution(10, 20, 30, 20, 10), 0, false},
+		{"candidate slower", testDistribution(50, 0, 0, 0, 0), testDistribution(0, 0, 50, 0, 0), 1, true},
+		{"candidate faster", testDistribution(0, 0, 0, 50, 0), testDistribution(0, 50, 0, 0, 0), -1, true},
+		{"all tied", testDistribution(0, 40, 0, 0, 0), testDistribution(0, 40, 0, 0, 0), 0, false},
+	}
+	for _, tt := range tests {
+		r := mannWhitney(tt.a, tt.b)
+		if math.Abs(r.CliffsDelta-tt.wantDelta) > 1e-9 {
+			t.Errorf("%s: Cliff's delta %f, want %f", tt.name, r.CliffsDelta, tt.wantDelta)
+		}
+		if lowP := r.P < 0.001; lowP != tt.wantLowP {
+			t.Errorf("%s: p %g, want below 0.001: %t", tt.name, r.P, tt.wantLowP)
+		}
+	}
+}
+
+func TestKolmogorovSmirnov(t *testing.T) {
+	tests := []struct {
+		name     string
+		a, b     distribution
+		wantD    float64
+		wantLowP bool
+	}{
+		{"same", testDistribution(10, 20, 30, 20, 10), testDistribution(10, 20, 30, 20, 10), 0, false},
+		{"separated", testDistribution(100, 0, 0, 0, 0), testDistribution(0, 0, 0, 100, 0), 1, true},
+		{"half shifted", testDistribution(50, 50, 0, 0, 0), testDistribution(0, 50, 50, 0, 0), 0.5, true},
+	}
+	for _, tt := range tests {
+		r := kolmogorovSmirnov(tt.a, tt.b)
+		if math.Abs(r.D-tt.wantD) > 1e-9 {
+			t.Errorf("%s: D %f, want %f", tt.name, r.D, tt.wantD)
+		}
+		if lowP := r.P < 0.001; lowP != tt.wantLowP {
+			t.Errorf("%s: p %g, want below 0.001: %t", tt.name, r.P, tt.wantLowP)
+		}
+	}
+}
+
+func TestKsProbability(t *testing.T) {
+	tests := []struct {
+		lambda, want float64
+	}{
+		{0.1, 1},
+		{1.36, 0.049},
+		{1.63, 0.0098},
+	}
+	for _, tt := range tests {
+		if got := ksProbability(tt.lambda); math.Abs(got-tt.want) > 0.001 {
+			t.Errorf("ksProbability(%g): got %g, want %g", tt.lambda, got, tt.want)
+		}
+	}
+}
+
+func TestBinomial(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	tests := []struct {
+		n int64
+		p float64
+	}{
+		{0, 0.5},
+		{100, 0},
+		{100, 1},
+		{1000, 0.003},
+		{100000, 0.2},
+		{100000, 0.9},
+		{50, 0.5},
+	}
+	for _, tt := range tests {
+		const draws = 2000
+		var sum float64
+		for i := 0; i < draws; i++ {
+			x := binomial(rng, tt.n, tt.p)
+			if x < 0 || x > tt.n {
+				t.Fatalf("binomial(%d, %g) = %d, out of range", tt.n, tt.p, x)
+			}
+			sum += float64(x)
+		}
+		mean := float64(tt.n) * tt.p
+		stderr := math.Sqrt(mean*(1-tt.p)/draws) + 1e-9
+		if got := sum / draws; math.Abs(got-mean) > 5*stderr {
+			t.Errorf("binomial(%d, %g): mean %f, want %f", tt.n, tt.p, got, mean)
+		}
+	}
+}
+
+func TestResampleKeepsSize(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, d := range []distribution{
+		testDistribution(0, 1e6, 0, 0, 0),
+		testDistribution(3, 1, 4, 1, 5),
+		testDistribution(1e5, 2e5, 3e5, 1e4, 7),
+	} {
+		counts := d.resample(rng)
+		var total float64
+		for i, n := range counts {
+			if d.counts[i] == 0 && n != 0 {
+				t.Errorf("resample of %v drew from empty bucket %d", d.counts, i)
+			}
+			total += n
+		}
+		if total != d.n {
+			t.Errorf("resample of %v drew %g samples, want %g", d.counts, total, d.n)
+		}
+	}
+}
+
+func TestBootstrapChange(t *testing.T) {
+	tests := []struct {
+		name            string
+		a, b            distribution
+		wantSignificant bool
+	}{
+		{"same", testDistribution(1e5, 2e5, 1e5, 1e4, 0), testDistribution(1e5, 2e5, 1e5, 1e4, 0), false},
+		{"slower", testDistribution(1e5, 2e5, 1e5, 1e4, 0), testDistribution(0, 1e5, 2e5, 1e5, 1e4), true},
+	}
+	for _, tt := range tests {
+		c := bootstrapChange(tt.a, tt.b, 0.5, 0.95, 1000, rand.New(rand.NewSource(1)))
+		if c.Significant != tt.wantSignificant {
+			t.Errorf("%s: significant %t, want %t (%+v)", tt.name, c.Significant, tt.wantSignificant, c)
+		}
+		if c.LowerMs > c.DiffMs || c.UpperMs < c.DiffMs {
+			t.Errorf("%s: interval [%f, %f] misses the change %f", tt.name, c.LowerMs, c.UpperMs, c.DiffMs)
+		}
+	}
+}
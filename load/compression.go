@@ -0,0 +1,60 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+func newDecoder(encoding string, r io.Reader) (io.ReadCloser, error) {
+	switch encoding {
+	case "gzip":
+		return gzip.NewReader(r)
+	case "br":
+		return ioutil.NopCloser(brotli.NewReader(r)), nil
+	case "zstd":
+		decoder, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	}
+	return nil, fmt.Errorf("unsupported encoding %q", encoding)
+}
+
+// readResponse copies the response body to w, decoding it when it was sent
+// compressed, and returns the encoding it used. Bodies that expand beyond
+// maxDecodedBytes are treated as decompression bombs.
+func readResponse(resp *http.Response, w io.Writer) (string, error) {
+	encoding := strings.ToLower(resp.Header.Get("Content-Encoding"))
+	if resp.Uncompressed {
+		encoding = "gzip"
+	}
+
+	var body io.Reader = resp.Body
+	if encoding != "" && encoding != "identity" && !resp.Uncompressed {
+		decoder, err := newDecoder(encoding, resp.Body)
+		if err != nil {
+			return encoding, err
+		}
+		defer decoder.Close()
+		body = decoder
+	}
+	if encoding == "" {
+		encoding = "identity"
+	}
+
+	n, err := io.Copy(w, io.LimitReader(body, maxDecodedBytes+1))
+	if err != nil {
+		return encoding, err
+	}
+	if n > maxDecodedBytes {
+		return encoding, fmt.Errorf("decoded body exceeds %d bytes", maxDecodedBytes)
+	}
+	return encoding, nil
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// curl options that take an argument but do not change the request.
+var ignoredCurlArgs = map[string]bool{
+	"-o": true, "--output": true, "-m": true, "--max-time": true,
+	"--connect-timeout": true, "-w": true, "--write-out": true,
+	"--retry": true, "--retry-delay": true, "--cacert": true, "--cert": true,
+	"--key": true, "-x": true, "--proxy": true, "--resolve": true,
+	"-c": true, "--cookie-jar": true, "--limit-rate": true,
+}
+
+// curl options that only change curl's own output or connection handling.
+var silentCurlFlags = map[string]bool{
+	"-s": true, "--silent": true, "-S": true, "--show-error": true,
+	"-L": true, "--location": true, "-k": true, "--insecure": true,
+	"-v": true, "--verbose": true, "-i": true, "--include": true,
+	"--compressed": true, "-f": true, "--fail": true,
+}
+
+// splitShellWords splits a command line the way a POSIX shell would for
+// plain words, single and double quotes and backslash escapes.
+func splitShellWords(line string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == '\'':
+			end := strings.IndexByte(line[i+1:], '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated single quote")
+			}
+			word.WriteString(line[i+1 : i+1+end])
+			i += end + 1
+			inWord = true
+		case c == '"':
+			i++
+			for ; i < len(line) && line[i] != '"'; i++ {
+				if line[i] == '\\' && i+1 < len(line) && strings.IndexByte("$`\"\\\n", line[i+1]) >= 0 {
+					i++
+				}
+				word.WriteByte(line[i])
+			}
+			if i >= len(line) {
+				return nil, fmt.Errorf("unterminated double quote")
+			}
+			inWord = true
+		case c == '\\' && i+1 < len(line):
+			i++
+			if line[i] != '\n' {
+				word.WriteByte(line[i])
+				inWord = true
+			}
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// convertCurl turns the words of a curl command into a request.
+func convertCurl(words []string) (scenarioRequest, error) {
+	if len(words) == 0 || words[0] != "curl" {
+		return scenarioRequest{}, fmt.Errorf("not a curl command")
+	}
+	r := scenarioRequest{Headers: map[string]string{}}
+	var data []string
+	get, head := false, false
+
+	for i := 1; i < len(words); i++ {
+		word := words[i]
+		arg := func() (string, error) {
+			// --option=value
+			if strings.HasPrefix(word, "--") && strings.Contains(word, "=") {
+				return word[strings.Index(word, "=")+1:], nil
+			}
+			// -Hvalue
+			if !strings.HasPrefix(word, "--") && len(word) > 2 {
+				return word[2:], nil
+			}
+			if i+1 >= len(words) {
+				return "", fmt.Errorf("%s needs an argument", word)
+			}
+			i++
+			return words[i], nil
+		}
+		name := word
+		if strings.HasPrefix(word, "--") && strings.Contains(word, "=") {
+			name = word[:strings.Index(word, "=")]
+		} else if strings.HasPrefix(word, "-") && !strings.HasPrefix(word, "--") && len(word) > 2 {
+			name = word[:2]
+		}
+
+		var value string
+		var err error
+		switch name {
+		case "-X", "--request", "-H", "--header", "-d", "--data", "--data-raw", "--data-binary",
+			"--data-ascii", "--data-urlencode", "--json", "-u", "--user", "-A", "--user-agent",
+			"-e", "--referer", "-b", "--cookie", "--url":
+			if value, err = arg(); err != nil {
+				return r, err
+			}
+		}
+
+		switch name {
+		case "-X", "--request":
+			r.Method = strings.ToUpper(value)
+		case "-H", "--header":
+			parts := strings.SplitN(value, ":", 2)
+			if len(parts) != 2 {
+				return r, fmt.Errorf("bad header %q", value)
+			}
+			r.Headers[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+		case "-d", "--data", "--data-ascii", "--data-binary":
+			if strings.HasPrefix(value, "@") {
+				if value, err = readCurlFile(value[1:], name != "--data-binary"); err != nil {
+					return r, err
+				}
+			}
+			data = append(data, value)
+		case "--data-raw":
+			data = append(data, value)
+		case "--data-urlencode":
+			// like curl: content, =content, name=content, @file or
+			// name@file, whichever of = and @ comes first deciding
+			i := strings.IndexAny(value, "=@")
+			switch {
+			case i < 0:
+				data = append(data, url.QueryEscape(value))
+			case value[i] == '=' && i == 0:
+				data = append(data, url.QueryEscape(value[1:]))
+			case value[i] == '=':
+				data = append(data, value[:i+1]+url.QueryEscape(value[i+1:]))
+			default:
+				content, err := readCurlFile(value[i+1:], false)
+				if err != nil {
+					return r, err
+				}
+				name := value[:i]
+				if name != "" {
+					name += "="
+				}
+				data = append(data, name+url.QueryEscape(content))
+			}
+		case "--json":
+			if strings.HasPrefix(value, "@") {
+				if value, err = readCurlFile(value[1:], false); err != nil {
+					return r, err
+				}
+			}
+			data = append(data, value)
+			r.Headers["Content-Type"] = "application/json"
+			r.Headers["Accept"] = "application/json"
+		case "-u", "--user":
+			r.Headers["Authorization"] = "Basic " + base64.StdEncoding.EncodeToString([]byte(value))
+		case "-A", "--user-agent":
+			r.Headers["User-Agent"] = value
+		case "-e", "--referer":
+			r.Headers["Referer"] = value
+		case "-b", "--cookie":
+			r.Headers["Cookie"] = value
+		case "-G", "--get":
+			get = true
+		case "-I", "--head":
+			head = true
+		case "--url":
+			r.URL = value
+		default:
+			if ignoredCurlArgs[name] {
+				if _, err := arg(); err != nil {
+					return r, err
+				}
+			} else if strings.HasPrefix(word, "-") {
+				if !silentCurlFlags[name] {
+					fmt.Fprintf(os.Stderr, "Ignoring curl option %s\n", word)
+				}
+			} else if r.URL == "" {
+				r.URL = word
+			} else {
+				return r, fmt.Errorf("unexpected argument %q", word)
+			}
+		}
+	}
+
+	if r.URL == "" {
+		return r, fmt.Errorf("no URL")
+	}
+	if !strings.Contains(r.URL, "://") {
+		r.URL = "http://" + r.URL
+	}
+	switch {
+	case get && len(data) > 0:
+		separator := "?"
+		if strings.Contains(r.URL, "?") {
+			separator = "&"
+		}
+		r.URL += separator + strings.Join(data, "&")
+	case len(data) > 0:
+		r.Body = strings.Join(data, "&")
+		if _, ok := r.Headers["Content-Type"]; !ok {
+			r.Headers["Content-Type"] = "application/x-www-form-urlencoded"
+		}
+	}
+	if r.Method == "" {
+		switch {
+		case head:
+			r.Method = "HEAD"
+		case len(data) > 0 && !get:
+			r.Method = "POST"
+		default:
+			r.Method = "GET"
+		}
+	}
+	if len(r.Headers) == 0 {
+		r.Headers = nil
+	}
+	return r, nil
+}
+
+// readCurlFile reads the file of a @file data argument. Like curl, -d and
+// --data-ascii drop line breaks while --data-binary keeps the file as is.
+func readCurlFile(path string, stripNewlines bool) (string, error) {
+	if path == "-" {
+		return "", fmt.Errorf("data from standard input is not supported")
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	if stripNewlines {
+		return strings.NewReplacer("\r", "", "\n", "").Replace(string(content)), nil
+	}
+	return string(content), nil
+}
+
+// readCurlCommands reads curl commands, one per line with backslash
+// continuations, skipping blank lines and comments.
+func readCurlCommands(r io.Reader) ([]string, error) {
+	var commands []string
+	var current strings.Builder
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 10<<20)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if current.Len() == 0 && (strings.TrimSpace(line) == "" || strings.HasPrefix(strings.TrimSpace(line), "#")) {
+			continue
+		}
+		if strings.HasSuffix(line, "\\") {
+			current.WriteString(strings.TrimSuffix(line, "\\") + " ")
+			continue
+		}
+		current.WriteString(line)
+		commands = append(commands, current.String())
+		current.Reset()
+	}
+	if current.Len() > 0 {
+		commands = append(commands, current.String())
+	}
+	return commands, scanner.Err()
+}
+
+// runImportCurl implements the import-curl command: every curl command read
+// from the file, or standard input, becomes a request of a single page.
+func runImportCurl(args []string) {
+	flags := flag.NewFlagSet("import-curl", flag.ExitOnError)
+	name := flags.String("name", "curl", "scenario name")
+	absolute := flags.Bool("absolute", false, "keep URLs absolute instead of resolving them against TARGET_URL")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: load import-curl [flags] [COMMANDS_FILE]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() > 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	var input io.Reader = os.Stdin
+	source := "stdin"
+	if flags.NArg() == 1 {
+		f, err := os.Open(flags.Arg(0))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		defer f.Close()
+		input, source = f, filepath.Base(flags.Arg(0))
+	}
+
+	commands, err := readCurlCommands(input)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	p := page{Name: source}
+	for i, command := range commands {
+		words, err := splitShellWords(command)
+		if err == nil {
+			var r scenarioRequest
+			if r, err = convertCurl(words); err == nil {
+				if !*absolute {
+					r.URL = relativeURL(r.URL)
+				}
+				p.Requests = append(p.Requests, r)
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: command %d: %s\n", source, i+1, err)
+			os.Exit(2)
+		}
+	}
+	writeScenario(scenario{Name: *name, Pages: []page{p}})
+}
+
+// relativeURL strips the scheme and host from an absolute URL so it is
+// resolved against TARGET_URL.
+func relativeURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" || strings.Contains(u.Host, "{{") {
+		return raw
+	}
+	return u.RequestURI()
+}
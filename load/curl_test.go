@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitShellWords(t *testing.T) {
+	tests := []struct {
+		line    string
+		want    []string
+		wantErr bool
+	}{
+		{`curl http://a/`, []string{"curl", "http://a/"}, false},
+		{`  curl   -H  'X: y z'  `, []string{"curl", "-H", "X: y z"}, false},
+		{`curl -d "a \"b\" \$c \n"`, []string{"curl", "-d", `a "b" $c \n`}, false},
+		{`curl -d 'it'\''s'`, []string{"curl", "-d", "it's"}, false},
+		{`curl a\ b`, []string{"curl", "a b"}, false},
+		{`curl '' x`, []string{"curl", "", "x"}, false},
+		{`curl 'open`, nil, true},
+		{`curl "open`, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := splitShellWords(tt.line)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("splitShellWords(%q): error %v, want error: %t", tt.line, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitShellWords(%q): got %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestConvertCurl(t *testing.T) {
+	dir, err := ioutil.TempDir("", "curl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "data.txt")
+	if err := ioutil.WriteFile(file, []byte("a=1\nb=2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		command string
+		want    scenarioRequest
+		wantErr bool
+	}{
+		{
+			command: `curl https://api.example/items`,
+			want:    scenarioRequest{Method: "GET", URL: "https://api.example/items"},
+		},
+		{
+			command: `curl api.example/items -I`,
+			want:    scenarioRequest{Method: "HEAD", URL: "http://api.example/items"},
+		},
+		{
+			command: `curl -X put -H 'Content-Type: application/json' --data-raw '{"a":1}' https://api.example/items/1`,
+			want: scenarioRequest{Method: "PUT", URL: "https://api.example/items/1", Body: `{"a":1}`,
+				Headers: map[string]string{"Content-Type": "application/json"}},
+		},
+		{
+			command: `curl -d a=1 --data b=2 https://api.example/form`,
+			want: scenarioRequest{Method: "POST", URL: "https://api.example/form", Body: "a=1&b=2",
+				Headers: map[string]string{"Content-Type": "application/x-www-form-urlencoded"}},
+		},
+		{
+			command: `curl -G -d q=go --data-urlencode 'name=a b' 'https://api.example/search?x=1'`,
+			want:    scenarioRequest{Method: "GET", URL: "https://api.example/search?x=1&q=go&name=a+b"},
+		},
+		{
+			command: `curl --json '{"a":1}' -u user:pass -A agent -e https://ref/ -b 'c=1' -s --compressed -o out.txt --url https://api.example/`,
+			want: scenarioRequest{Method: "POST", URL: "https://api.example/", Body: `{"a":1}`, Headers: map[string]string{
+				"Content-Type":  "application/json",
+				"Accept":        "application/json",
+				"Authorization": "Basic dXNlcjpwYXNz",
+				"User-Agent":    "agent",
+				"Referer":       "https://ref/",
+				"Cookie":        "c=1",
+			}},
+		},
+		{
+			command: `curl -HX-One:1 --header=X-Two:2 https://api.example/`,
+			want: scenarioRequest{Method: "GET", URL: "https://api.example/",
+				Headers: map[string]string{"X-One": "1", "X-Two": "2"}},
+		},
+		{
+			command: `curl --data-urlencode '=a b' --data-urlencode n@` + file + ` --data-urlencode @` + file + ` --data-urlencode 'x=1@2' https://api.example/`,
+			want: scenarioRequest{Method: "POST", URL: "https://api.example/",
+				Body:    "a+b&n=a%3D1%0Ab%3D2%0A&a%3D1%0Ab%3D2%0A&x=1%402",
+				Headers: map[string]string{"Content-Type": "application/x-www-form-urlencoded"}},
+		},
+		{
+			command: `curl -d @` + file + ` https://api.example/`,
+			want: scenarioRequest{Method: "POST", URL: "https://api.example/", Body: "a=1b=2",
+				Headers: map[string]string{"Content-Type": "application/x-www-form-urlencoded"}},
+		},
+		{
+			command: `curl --data-binary @` + file + ` https://api.example/`,
+			want: scenarioRequest{Method: "POST", URL: "https://api.example/", Body: "a=1\nb=2\n",
+				Headers: map[string]string{"Content-Type": "application/x-www-form-urlencoded"}},
+		},
+		{
+			command: `curl --data-raw @` + file + ` https://api.example/`,
+			want: scenarioRequest{Method: "POST", URL: "https://api.example/", Body: "@" + file,
+				Headers: map[string]string{"Content-Type": "application/x-www-form-urlencoded"}},
+		},
+		{command: `curl -d @` + filepath.Join(dir, "missing") + ` https://api.example/`, wantErr: true},
+		{command: `curl -d @- https://api.example/`, wantErr: true},
+		{command: `wget https://api.example/`, wantErr: true},
+		{command: `curl -H`, wantErr: true},
+		{command: `curl -H nocolon https://api.example/`, wantErr: true},
+		{command: `curl https://a/ https://b/`, wantErr: true},
+		{command: `curl -s`, wantErr: true},
+	}
+	for _, tt := range tests {
+		words, err := splitShellWords(tt.command)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.command, err)
+		}
+		got, err := convertCurl(words)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error %v, want error: %t", tt.command, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s:\ngot  %+v\nwant %+v", tt.command, got, tt.want)
+		}
+	}
+}
+
+func TestReadCurlCommands(t *testing.T) {
+	input := "# exported\n\ncurl -X POST \\\n  -d a=1 \\\n  http://a/\ncurl http://b/\n"
+	got, err := readCurlCommands(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"curl -X POST    -d a=1    http://a/", "curl http://b/"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestRelativeURL(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"https://api.example/a/b?c=1", "/a/b?c=1"},
+		{"/already/relative", "/already/relative"},
+		{"{{baseUrl}}/items", "{{baseUrl}}/items"},
+		{"https://{{host}}/items", "https://{{host}}/items"},
+	}
+	for _, tt := range tests {
+		if got := relativeURL(tt.in); got != tt.want {
+			t.Errorf("relativeURL(%q): got %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestConvertPostman(t *testing.T) {
+	collection := `{
+	  "info": {"name": "Shop", "schema": "https://schema.getpostman.com/json/collection/v2.1.0/collection.json"},
+	  "auth": {"type": "bearer", "bearer": [{"key": "token", "value": "{{token}}"}]},
+	  "variable": [{"key": "token", "value": "abc"}, {"key": "host", "value": "https://api.example"}],
+	  "item": [
+	    {"name": "Ping", "request": {"method": "get", "url": "{{host}}/ping"}},
+	    {"name": "Admin", "auth": {"type": "noauth"}, "item": [
+	      {"name": "Form", "request": {"method": "POST", "url": {"raw": "https://api.example/form"},
+	       "header": [{"key": "X-Off", "value": "1", "disabled": true}],
+	       "body": {"mode": "urlencoded", "urlencoded": [{"key": "a", "value": "1 2"}]}}}
+	    ]}
+	  ]
+	}`
+	var c postmanCollection
+	if err := json.Unmarshal([]byte(collection), &c); err != nil {
+		t.Fatal(err)
+	}
+	env := &postmanEnvironment{Values: []postmanKeyValue{{Key: "token", Value: "env"}}}
+	s, err := convertPostman(c, env, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := scenario{
+		Name:      "Shop",
+		Variables: map[string]string{"token": "env", "host": "https://api.example"},
+		Pages: []page{
+			{Name: "Shop", Requests: []scenarioRequest{{Name: "Ping", Method: "GET", URL: "{{host}}/ping",
+				Headers: map[string]string{"Authorization": "Bearer {{token}}"}}}},
+			{Name: "Admin", Requests: []scenarioRequest{{Name: "Form", Method: "POST", URL: "/form", Body: "a=1+2",
+				Headers: map[string]string{"Content-Type": "application/x-www-form-urlencoded"}}}},
+		},
+	}
+	if !reflect.DeepEqual(s, want) {
+		t.Errorf("got  %+v\nwant %+v", s, want)
+	}
+
+	var item postmanItem
+	form := `{"name": "x", "request": {"method": "POST", "url": "/", "body": {"mode": "formdata", "formdata": [
+	  {"key": "a", "value": "1"}, {"key": "off", "type": "file", "disabled": true}, {"key": "b", "value": "x y"}]}}}`
+	if err := json.Unmarshal([]byte(form), &item); err != nil {
+		t.Fatal(err)
+	}
+	r, err := convertPostmanItem(item, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantBody := "--failserver-form-boundary\r\nContent-Disposition: form-data; name=\"a\"\r\n\r\n1\r\n" +
+		"--failserver-form-boundary\r\nContent-Disposition: form-data; name=\"b\"\r\n\r\nx y\r\n" +
+		"--failserver-form-boundary--\r\n"
+	if r.Body != wantBody || r.Headers["Content-Type"] != "multipart/form-data; boundary=failserver-form-boundary" {
+		t.Errorf("form data: got %q with %q", r.Body, r.Headers)
+	}
+
+	for _, body := range []string{
+		`{"mode": "graphql"}`,
+		`{"mode": "file"}`,
+		`{"mode": "formdata", "formdata": [{"key": "f", "type": "file"}]}`,
+	} {
+		var item postmanItem
+		if err := json.Unmarshal([]byte(`{"name": "x", "request": {"method": "POST", "url": "/", "body": `+body+`}}`), &item); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := convertPostmanItem(item, nil); err == nil {
+			t.Errorf("body %s was accepted", body)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Duration is a time.Duration that reads JSON strings such as "250ms".
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"250ms\", got %s", b)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// hypothesis describes the steady state the target is expected to keep.
+// Failures are transport errors and 5xx responses.
+type hypothesis struct {
+	MaxErrorRate *float64 `json:"max_error_rate,omitempty"`
+	MaxP99       Duration `json:"max_p99,omitempty"`
+	MinRequests  float64  `json:"min_requests,omitempty"`
+}
+
+// experiment is a chaos experiment: the steady state is verified under load,
+// the fault is added to failserver's config, the steady state is verified
+// again and the original config is put back.
+type experiment struct {
+	Name        string     `json:"name"`
+	ControlURL  string     `json:"control_url"`
+	SteadyState hypothesis `json:"steady_state"`
+	Duration    Duration   `json:"duration"`
+	Fault       struct {
+		Rules     []json.RawMessage `json:"rules,omitempty"`
+		Incidents []json.RawMessage `json:"incidents,omitempty"`
+	} `json:"fault"`
+}
+
+type phaseReport struct {
+	Name         string    `json:"name"`
+	Start        time.Time `json:"start"`
+	End          time.Time `json:"end"`
+	Requests     float64   `json:"requests"`
+	ErrorRate    float64   `json:"error_rate"`
+	P99Ms        float64   `json:"p99_ms"`
+	Passed       bool      `json:"passed"`
+	Inconclusive bool      `json:"inconclusive,omitempty"`
+	Violations   []string  `json:"violations,omitempty"`
+}
+
+type experimentReport struct {
+	Name         string        `json:"name"`
+	Passed       bool          `json:"passed"`
+	Inconclusive bool          `json:"inconclusive,omitempty"`
+	Error        string        `json:"error,omitempty"`
+	Phases       []phaseReport `json:"phases"`
+}
+
+func loadExperiment(path string) (experiment, error) {
+	var e experiment
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return e, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&e); err != nil {
+		return e, fmt.Errorf("%s: %s", path, err)
+	}
+	if e.ControlURL == "" {
+		e.ControlURL = targetUrl
+	}
+	e.ControlURL = strings.TrimRight(e.ControlURL, "/")
+	if e.Duration <= 0 {
+		e.Duration = Duration(testTime)
+	}
+	if len(e.Fault.Rules) == 0 && len(e.Fault.Incidents) == 0 {
+		return e, fmt.Errorf("%s: fault must add at least one rule or incident", path)
+	}
+	return e, nil
+}
+
+func (h hypothesis) check(s snapshot) []string {
+	var violations []string
+	if h.MinRequests > 0 && s.responses() < h.MinRequests {
+		violations = append(violations, fmt.Sprintf("only %.0f responses, wanted at least %.0f", s.responses(), h.MinRequests))
+	}
+	if h.MaxErrorRate != nil && s.errorRate() > *h.MaxErrorRate {
+		violations = append(violations, fmt.Sprintf("error rate %.4f above %.4f", s.errorRate(), *h.MaxErrorRate))
+	}
+	if h.MaxP99 > 0 {
+		maxP99 := float64(time.Duration(h.MaxP99) / time.Microsecond)
+		// Without latencies, only transport errors, the error rate decides
+		if p99 := s.quantile(0.99); !math.IsNaN(p99) && p99 > maxP99 {
+			violations = append(violations, fmt.Sprintf("p99 %.1fms above %s", p99/1000, time.Duration(h.MaxP99)))
+		}
+	}
+	return violations
+}
+
+// runPhase generates load for the experiment's duration and checks the hypothesis against the
+// metrics recorded while it ran.
+func (e experiment) runPhase(name string, tickers []chan time.Time, gatherer prometheus.Gatherer) (phaseReport, error) {
+	report := phaseReport{Name: name, Start: time.Now()}
+	before, err := takeSnapshot(gatherer)
+	if err != nil {
+		return report, err
+	}
+	log.Printf("Phase %s started\n", name)
+	startTicking(tickers, time.Duration(e.Duration))
+	after, err := takeSnapshot(gatherer)
+	if err != nil {
+		return report, err
+	}
+
+	delta := after.since(before)
+	report.End = time.Now()
+	report.Requests = delta.responses()
+	report.ErrorRate = delta.errorRate()
+	report.P99Ms = msOrZero(delta.quantile(0.99))
+	if delta.responses()+delta.TransportErrors == 0 {
+		report.Inconclusive = true
+		log.Printf("Phase %s ended, inconclusive: no samples\n", name)
+		return report, nil
+	}
+	report.Violations = e.SteadyState.check(delta)
+	report.Passed = len(report.Violations) == 0
+	log.Printf("Phase %s ended, passed: %t %v\n", name, report.Passed, report.Violations)
+	return report, nil
+}
+
+// controlClient changes the target's config. It waits longer than the load's
+// client timeout, so a busy target does not keep the fault in place.
+var controlClient = &http.Client{Timeout: 10 * time.Second}
+
+func (e experiment) controlRequest(method string, body []byte) ([]byte, error) {
+	req, err := http.NewRequest(method, e.ControlURL+"/admin/config", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := controlClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s: %s: %s", method, req.URL, resp.Status, strings.TrimSpace(string(data)))
+	}
+	return data, nil
+}
+
+// injectFault adds the experiment's rules and incidents to the target's
+// config and returns the original config for the rollback.
+func (e experiment) injectFault() ([]byte, error) {
+	original, err := e.controlRequest("GET", nil)
+	if err != nil {
+		return nil, err
+	}
+	var cfg map[string]interface{}
+	if err := json.Unmarshal(original, &cfg); err != nil {
+		return nil, err
+	}
+
+	for key, additions := range map[string][]json.RawMessage{"rules": e.Fault.Rules, "incidents": e.Fault.Incidents} {
+		existing, _ := cfg[key].([]interface{})
+		for _, raw := range additions {
+			var item interface{}
+			if err := json.Unmarshal(raw, &item); err != nil {
+				return nil, err
+			}
+			existing = append(existing, item)
+		}
+		if len(existing) > 0 {
+			cfg[key] = existing
+		}
+	}
+
+	faulty, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := e.controlRequest("PUT", faulty); err != nil {
+		return nil, err
+	}
+	return original, nil
+}
+
+func (e experiment) run(tickers []chan time.Time, gatherer prometheus.Gatherer) experimentReport {
+	report := experimentReport{Name: e.Name}
+	fail := func(err error) experimentReport {
+		report.Error = err.Error()
+		report.Passed = false
+		return report
+	}
+
+	baseline, err := e.runPhase("steady-state", tickers, gatherer)
+	report.Phases = append(report.Phases, baseline)
+	if err != nil {
+		return fail(err)
+	}
+	if baseline.Inconclusive {
+		report.Inconclusive = true
+		return fail(fmt.Errorf("no samples before injecting the fault"))
+	}
+	if !baseline.Passed {
+		return fail(fmt.Errorf("steady state not met before injecting the fault"))
+	}
+
+	log.Println("Injecting fault")
+	original, err := e.injectFault()
+	if err != nil {
+		return fail(err)
+	}
+	faulted, err := e.runPhase("fault", tickers, gatherer)
+	report.Phases = append(report.Phases, faulted)
+
+	log.Println("Rolling back fault")
+	if _, rollbackErr := e.controlRequest("PUT", original); rollbackErr != nil {
+		log.Printf("Rollback failed, the fault is still in place at %s: %s\n", e.ControlURL, rollbackErr)
+		return fail(fmt.Errorf("rollback failed: %s", rollbackErr))
+	}
+	if err != nil {
+		return fail(err)
+	}
+	if faulted.Inconclusive {
+		report.Inconclusive = true
+		return fail(fmt.Errorf("no samples while the fault was injected"))
+	}
+	report.Passed = faulted.Passed
+	return report
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+type harFile struct {
+	Log struct {
+		Pages []struct {
+			ID              string    `json:"id"`
+			Title           string    `json:"title"`
+			StartedDateTime time.Time `json:"startedDateTime"`
+		} `json:"pages"`
+		Entries []harEntry `json:"entries"`
+	} `json:"log"`
+}
+
+type harEntry struct {
+	PageRef         string    `json:"pageref"`
+	StartedDateTime time.Time `json:"startedDateTime"`
+	Time            float64   `json:"time"`
+	Request         struct {
+		Method  string `json:"method"`
+		URL     string `json:"url"`
+		Headers []struct {
+			Name  string `json:"name"`
+			Value string `json:"value"`
+		} `json:"headers"`
+		PostData *struct {
+			MimeType string `json:"mimeType"`
+			Text     string `json:"text"`
+		} `json:"postData"`
+	} `json:"request"`
+}
+
+func (e harEntry) end() time.Time {
+	return e.StartedDateTime.Add(time.Duration(e.Time * float64(time.Millisecond)))
+}
+
+// Headers the HTTP client sets itself or that only make sense on the
+// recorded connection.
+var skippedHarHeaders = map[string]bool{
+	"host":              true,
+	"content-length":    true,
+	"connection":        true,
+	"keep-alive":        true,
+	"transfer-encoding": true,
+	"upgrade":           true,
+}
+
+type harOptions struct {
+	firstParty     map[string]bool
+	keepThirdParty bool
+	absolute       bool
+	maxThinkTime   time.Duration
+}
+
+// convertHar turns a HAR recording into a scenario. Entries are grouped by
+// page; a page's think time is the gap between its last response and the
+// next page's first request.
+func convertHar(har harFile, opts harOptions) (scenario, error) {
+	entries := har.Log.Entries
+	if len(entries) == 0 {
+		return scenario{}, fmt.Errorf("the recording has no entries")
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].StartedDateTime.Before(entries[j].StartedDateTime) })
+
+	if len(opts.firstParty) == 0 {
+		first, err := url.Parse(entries[0].Request.URL)
+		if err != nil {
+			return scenario{}, err
+		}
+		opts.firstParty = map[string]bool{first.Hostname(): true}
+	}
+
+	titles := map[string]string{}
+	for _, p := range har.Log.Pages {
+		titles[p.ID] = p.Title
+	}
+
+	var s scenario
+	var pageEntries [][]harEntry
+	index := map[string]int{}
+	for _, e := range entries {
+		i, ok := index[e.PageRef]
+		if !ok {
+			i = len(s.Pages)
+			index[e.PageRef] = i
+			name := titles[e.PageRef]
+			if name == "" {
+				name = e.PageRef
+			}
+			if name == "" {
+				name = "recording"
+			}
+			s.Pages = append(s.Pages, page{Name: name})
+			pageEntries = append(pageEntries, nil)
+		}
+		pageEntries[i] = append(pageEntries[i], e)
+	}
+
+	for i := range s.Pages {
+		var lastEnd time.Time
+		for _, e := range pageEntries[i] {
+			if e.end().After(lastEnd) {
+				lastEnd = e.end()
+			}
+			r, keep, err := convertHarEntry(e, opts)
+			if err != nil {
+				return scenario{}, err
+			}
+			if keep {
+				s.Pages[i].Requests = append(s.Pages[i].Requests, r)
+			}
+		}
+		if i+1 < len(s.Pages) {
+			think := pageEntries[i+1][0].StartedDateTime.Sub(lastEnd)
+			if think < 0 {
+				think = 0
+			}
+			if opts.maxThinkTime > 0 && think > opts.maxThinkTime {
+				think = opts.maxThinkTime
+			}
+			s.Pages[i].ThinkTime = Duration(think.Round(time.Millisecond))
+		}
+	}
+	return s, nil
+}
+
+func convertHarEntry(e harEntry, opts harOptions) (scenarioRequest, bool, error) {
+	u, err := url.Parse(e.Request.URL)
+	if err != nil {
+		return scenarioRequest{}, false, err
+	}
+	if !opts.firstParty[u.Hostname()] && !opts.keepThirdParty {
+		return scenarioRequest{}, false, nil
+	}
+
+	r := scenarioRequest{Method: e.Request.Method, URL: e.Request.URL}
+	if opts.firstParty[u.Hostname()] && !opts.absolute {
+		r.URL = u.RequestURI()
+	}
+	for _, h := range e.Request.Headers {
+		name := strings.ToLower(h.Name)
+		if strings.HasPrefix(name, ":") || skippedHarHeaders[name] {
+			continue
+		}
+		if r.Headers == nil {
+			r.Headers = map[string]string{}
+		}
+		r.Headers[h.Name] = h.Value
+	}
+	if e.Request.PostData != nil {
+		r.Body = e.Request.PostData.Text
+		if e.Request.PostData.MimeType != "" {
+			if r.Headers == nil {
+				r.Headers = map[string]string{}
+			}
+			if _, ok := r.Headers["Content-Type"]; !ok {
+				r.Headers["Content-Type"] = e.Request.PostData.MimeType
+			}
+		}
+	}
+	return r, true, nil
+}
+
+// runImportHar implements the import-har command, printing the scenario
+// converted from a HAR file.
+func runImportHar(args []string) {
+	flags := flag.NewFlagSet("import-har", flag.ExitOnError)
+	domains := flags.String("domains", "", "comma separated first-party hosts (default: the host of the first request)")
+	keepThirdParty := flags.Bool("keep-third-party", false, "keep requests to other hosts")
+	absolute := flags.Bool("absolute", false, "keep first-party URLs absolute instead of resolving them against TARGET_URL")
+	maxThinkTime := flags.Duration("max-think-time", 0, "cap think times at this duration")
+	name := flags.String("name", "", "scenario name (default: the file name)")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: load import-har [flags] RECORDING.har")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	data, err := ioutil.ReadFile(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	var har harFile
+	if err := json.Unmarshal(data, &har); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", flags.Arg(0), err)
+		os.Exit(2)
+	}
+
+	opts := harOptions{firstParty: map[string]bool{}, keepThirdParty: *keepThirdParty, absolute: *absolute, maxThinkTime: *maxThinkTime}
+	for _, domain := range splitList(*domains) {
+		opts.firstParty[domain] = true
+	}
+	s, err := convertHar(har, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", flags.Arg(0), err)
+		os.Exit(2)
+	}
+	s.Name = *name
+	if s.Name == "" {
+		s.Name = strings.TrimSuffix(filepath.Base(flags.Arg(0)), ".har")
+	}
+	writeScenario(s)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const testHar = `{"log": {
+  "pages": [
+    {"id": "page_1", "title": "Home", "startedDateTime": "2026-10-16T10:00:00Z"},
+    {"id": "page_2", "title": "Cart", "startedDateTime": "2026-10-16T10:00:05Z"}
+  ],
+  "entries": [
+    {"pageref": "page_2", "startedDateTime": "2026-10-16T10:00:05Z", "time": 100,
+     "request": {"method": "POST", "url": "https://shop.example/cart?id=1",
+                 "headers": [{"name": ":authority", "value": "shop.example"}, {"name": "Content-Length", "value": "7"}],
+                 "postData": {"mimeType": "application/json", "text": "{\"a\":1}"}}},
+    {"pageref": "page_1", "startedDateTime": "2026-10-16T10:00:00Z", "time": 200,
+     "request": {"method": "GET", "url": "https://shop.example/",
+                 "headers": [{"name": "Accept", "value": "text/html"}, {"name": "Host", "value": "shop.example"}]}},
+    {"pageref": "page_1", "startedDateTime": "2026-10-16T10:00:00.100Z", "time": 1900,
+     "request": {"method": "GET", "url": "https://cdn.other/app.js", "headers": []}}
+  ]
+}}`
+
+func TestConvertHar(t *testing.T) {
+	var har harFile
+	if err := json.Unmarshal([]byte(testHar), &har); err != nil {
+		t.Fatal(err)
+	}
+	home := scenarioRequest{Method: "GET", URL: "/", Headers: map[string]string{"Accept": "text/html"}}
+	cdn := scenarioRequest{Method: "GET", URL: "https://cdn.other/app.js"}
+	cart := scenarioRequest{
+		Method:  "POST",
+		URL:     "/cart?id=1",
+		Headers: map[string]string{"Content-Type": "application/json"},
+		Body:    `{"a":1}`,
+	}
+
+	tests := []struct {
+		name string
+		opts harOptions
+		want []page
+	}{
+		{
+			name: "first party only",
+			want: []page{
+				// the think time runs from the end of the slowest request
+				{Name: "Home", ThinkTime: Duration(3 * time.Second), Requests: []scenarioRequest{home}},
+				{Name: "Cart", Requests: []scenarioRequest{cart}},
+			},
+		},
+		{
+			name: "third party kept, think time capped",
+			opts: harOptions{keepThirdParty: true, maxThinkTime: time.Second},
+			want: []page{
+				{Name: "Home", ThinkTime: Duration(time.Second), Requests: []scenarioRequest{home, cdn}},
+				{Name: "Cart", Requests: []scenarioRequest{cart}},
+			},
+		},
+		{
+			name: "absolute",
+			opts: harOptions{absolute: true},
+			want: []page{
+				{Name: "Home", ThinkTime: Duration(3 * time.Second), Requests: []scenarioRequest{
+					{Method: "GET", URL: "https://shop.example/", Headers: home.Headers},
+				}},
+				{Name: "Cart", Requests: []scenarioRequest{
+					{Method: "POST", URL: "https://shop.example/cart?id=1", Headers: cart.Headers, Body: cart.Body},
+				}},
+			},
+		},
+		{
+			name: "explicit first party",
+			opts: harOptions{firstParty: map[string]bool{"cdn.other": true}},
+			want: []page{
+				{Name: "Home", ThinkTime: Duration(3 * time.Second), Requests: []scenarioRequest{{Method: "GET", URL: "/app.js"}}},
+				{Name: "Cart"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		s, err := convertHar(har, tt.opts)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(s.Pages, tt.want) {
+			t.Errorf("%s:\ngot  %+v\nwant %+v", tt.name, s.Pages, tt.want)
+		}
+	}
+}
+
+func TestConvertHarWithoutPages(t *testing.T) {
+	var har harFile
+	har.Log.Entries = []harEntry{{}, {}}
+	har.Log.Entries[0].Request.Method = "GET"
+	har.Log.Entries[0].Request.URL = "http://a.example/x"
+	har.Log.Entries[1].Request.Method = "GET"
+	har.Log.Entries[1].Request.URL = "http://a.example/y"
+
+	s, err := convertHar(har, harOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Pages) != 1 || s.Pages[0].Name != "recording" || len(s.Pages[0].Requests) != 2 {
+		t.Errorf("got %+v, want one page named recording with both requests", s.Pages)
+	}
+
+	if _, err := convertHar(harFile{}, harOptions{}); err == nil {
+		t.Error("an empty recording was accepted")
+	}
+}
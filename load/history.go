@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// historyEntry is the summary of one run kept in the history file.
+type historyEntry struct {
+	Scenario      string            `json:"scenario"`
+	RunID         string            `json:"run_id"`
+	Start         time.Time         `json:"start"`
+	End           time.Time         `json:"end"`
+	TargetVersion string            `json:"target_version"`
+	Tags          map[string]string `json:"tags,omitempty"`
+	Requests      float64           `json:"requests"`
+	ErrorRate     float64           `json:"error_rate"`
+	MeanMs        float64           `json:"mean_ms"`
+	P50Ms         float64           `json:"p50_ms"`
+	P99Ms         float64           `json:"p99_ms"`
+}
+
+func newHistoryEntry(report runReport) historyEntry {
+	m := report.Metadata
+	return historyEntry{
+		Scenario:      m.Scenario,
+		RunID:         m.RunID,
+		Start:         m.Start,
+		End:           m.End,
+		TargetVersion: m.TargetVersion,
+		Tags:          m.Tags,
+		Requests:      report.Client.Requests,
+		ErrorRate:     report.Client.ErrorRate,
+		MeanMs:        report.Client.MeanMs,
+		P50Ms:         report.Client.P50Ms,
+		P99Ms:         report.Client.P99Ms,
+	}
+}
+
+// appendHistory adds one line to the JSON lines history file.
+func appendHistory(path string, entry historyEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func readHistory(path string) ([]historyEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []historyEntry
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry historyEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, line, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+func median(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
+
+// slope is the least squares slope of values against their index, i.e. the
+// average change per run.
+func slope(values []float64) float64 {
+	n := float64(len(values))
+	if n < 2 {
+		return 0
+	}
+	var sumX, sumY, sumXY, sumXX float64
+	for i, y := range values {
+		x := float64(i)
+		sumX += x
+		sumY += y
+		sumXY += x * y
+		sumXX += x * x
+	}
+	return (n*sumXY - sumX*sumY) / (n*sumXX - sumX*sumX)
+}
+
+// regressions compares a run with the median of the runs before it.
+func regressions(entry historyEntry, previous []historyEntry, p99Threshold, errorThreshold float64) []string {
+	if len(previous) == 0 {
+		return nil
+	}
+	var p99s, errorRates []float64
+	for _, e := range previous {
+		p99s = append(p99s, e.P99Ms)
+		errorRates = append(errorRates, e.ErrorRate)
+	}
+
+	var found []string
+	if baseline := median(p99s); baseline > 0 && entry.P99Ms > baseline*(1+p99Threshold) {
+		found = append(found, fmt.Sprintf("p99 %.1fms is %.0f%% above the %.1fms median", entry.P99Ms, (entry.P99Ms/baseline-1)*100, baseline))
+	}
+	if baseline := median(errorRates); entry.ErrorRate > baseline+errorThreshold {
+		found = append(found, fmt.Sprintf("error rate %.4f is above the %.4f median", entry.ErrorRate, baseline))
+	}
+	return found
+}
+
+// runHistory implements the history command. It prints the last runs of
+// every scenario and exits with 1 when the latest run of one regressed.
+func runHistory(args []string) {
+	flags := flag.NewFlagSet("history", flag.ExitOnError)
+	path := flags.String("file", getStringEnv("HISTORY_FILE", "results/history.jsonl"), "history file to read")
+	scenario := flags.String("scenario", "", "only show this scenario")
+	last := flags.Int("n", 10, "number of runs to show per scenario")
+	p99Threshold := flags.Float64("p99-threshold", 0.2, "relative p99 increase over the median of the previous runs that counts as a regression")
+	errorThreshold := flags.Float64("error-threshold", 0.01, "absolute error rate increase over the median of the previous runs that counts as a regression")
+	flags.Parse(args)
+
+	entries, err := readHistory(*path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	byScenario := map[string][]historyEntry{}
+	var scenarios []string
+	for _, e := range entries {
+		if *scenario != "" && e.Scenario != *scenario {
+			continue
+		}
+		if _, ok := byScenario[e.Scenario]; !ok {
+			scenarios = append(scenarios, e.Scenario)
+		}
+		byScenario[e.Scenario] = append(byScenario[e.Scenario], e)
+	}
+	sort.Strings(scenarios)
+
+	regressed := false
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, name := range scenarios {
+		runs := byScenario[name]
+		sort.SliceStable(runs, func(i, j int) bool { return runs[i].Start.Before(runs[j].Start) })
+		first := len(runs) - *last
+		if first < 0 {
+			first = 0
+		}
+
+		fmt.Fprintf(w, "Scenario %s\n", name)
+		fmt.Fprintln(w, "RUN\tSTART\tVERSION\tREQUESTS\tERROR RATE\tP99 MS\t")
+		var p99s []float64
+		for i := first; i < len(runs); i++ {
+			e := runs[i]
+			version := e.TargetVersion
+			if len(version) > 12 {
+				version = version[:12]
+			}
+			found := regressions(e, runs[first:i], *p99Threshold, *errorThreshold)
+			fmt.Fprintf(w, "%s\t%s\t%s\t%.0f\t%.4f\t%.1f\t", e.RunID, e.Start.Format(time.RFC3339), version, e.Requests, e.ErrorRate, e.P99Ms)
+			if len(found) > 0 {
+				fmt.Fprintf(w, " REGRESSION: %s", strings.Join(found, "; "))
+			}
+			fmt.Fprintln(w)
+			p99s = append(p99s, e.P99Ms)
+			if i == len(runs)-1 && len(found) > 0 {
+				regressed = true
+			}
+		}
+		fmt.Fprintf(w, "p99 trend over %d runs: %+.1fms per run\n\n", len(p99s), slope(p99s))
+	}
+	w.Flush()
+
+	if regressed {
+		os.Exit(1)
+	}
+}
@@ -15,6 +15,10 @@ import (
 )
 
 var (
+	// effectiveConfig records every setting read from the environment with
+	// the value in use
+	effectiveConfig = map[string]string{}
+
 	minTimeBetweenReqsMs = getIntEnv("MIN_REQ_TIME", 100)
 	minTimeBetweenReqs   = time.Duration(int64(minTimeBetweenReqsMs)) * time.Millisecond
 	clientTimeout        = time.Duration(int64(getIntEnv("CLIENT_TIMEOUT", minTimeBetweenReqsMs))) * time.Millisecond
@@ -23,6 +27,29 @@ var (
 	targetUrl            = getStringEnv("TARGET_URL", "http://localhost:8080")
 	pushGatewayAddress   = getStringEnv("PUSH_GATEWAY", "")
 	metricsOutputFile    = getStringEnv("METRICS_FILE", "")
+	experimentFile       = getStringEnv("EXPERIMENT_FILE", "")
+	experimentReportFile = getStringEnv("EXPERIMENT_REPORT_FILE", "")
+	reportFile           = getStringEnv("REPORT_FILE", "")
+	historyFile          = getStringEnv("HISTORY_FILE", "")
+	scriptFile           = getStringEnv("SCRIPT", "")
+	scenarioFile         = getStringEnv("SCENARIO_FILE", "")
+	serverMetricsUrls    = splitList(getStringEnv("SERVER_METRICS_URL", ""))
+	scrapeInterval       = time.Duration(int64(getIntEnv("SCRAPE_INTERVAL", 5))) * time.Second
+	acceptEncoding       = getStringEnv("ACCEPT_ENCODING", "")
+	maxDecodedBytes      = int64(getIntEnv("MAX_DECODED_BYTES", 10<<20))
+	replayFile           = getStringEnv("REPLAY_FILE", "")
+	replayFormat         = getStringEnv("REPLAY_FORMAT", "auto")
+	replaySpeed          = getFloatEnv("REPLAY_SPEED", 1)
+	replayAmplify        = getFloatEnv("REPLAY_AMPLIFY", 1)
+	maxInFlight          = getIntEnv("MAX_IN_FLIGHT", 1000)
+	rateFile             = getStringEnv("RATE_FILE", "")
+	rateDuration         = getStringEnv("RATE_DURATION", "")
+	rateScale            = getFloatEnv("RATE_SCALE", 1)
+	arrivalRate          = getFloatEnv("ARRIVAL_RATE", 0)
+	arrivalProcessSpec   = getStringEnv("ARRIVAL_PROCESS", "constant")
+	sessionLength        = getStringEnv("SESSION_LENGTH", "")
+	sessionThinkTime     = getStringEnv("THINK_TIME", "0")
+	sessionRate          = getFloatEnv("SESSION_RATE", 0)
 
 	requestDuration = prometheus.NewSummary(
 		prometheus.SummaryOpts{
@@ -51,6 +78,27 @@ var (
 			Help: "Number of failed HTTP requests",
 		},
 	)
+	responseEncodings = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "http_response_encodings_total",
+			Help: "Number of HTTP responses by Content-Encoding",
+		},
+		[]string{"encoding"},
+	)
+	decodeErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "http_decode_errors_total",
+			Help: "Number of HTTP responses whose body could not be decoded",
+		},
+		[]string{"encoding"},
+	)
+	hookRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "hook_requests_total",
+			Help: "Number of HTTP requests sent by setup, init and teardown",
+		},
+		[]string{"code"},
+	)
 )
 
 func getIntEnv(envKey string, alternative int) int {
@@ -58,17 +106,31 @@ func getIntEnv(envKey string, alternative int) int {
 	i, err := strconv.Atoi(envStr)
 
 	if err != nil {
-		return alternative
+		i = alternative
 	}
 
+	effectiveConfig[envKey] = strconv.Itoa(i)
 	return i
 }
 
+func getFloatEnv(envKey string, alternative float64) float64 {
+	envStr := os.Getenv(envKey)
+	f, err := strconv.ParseFloat(envStr, 64)
+
+	if err != nil {
+		f = alternative
+	}
+
+	effectiveConfig[envKey] = strconv.FormatFloat(f, 'g', -1, 64)
+	return f
+}
+
 func getStringEnv(envKey string, alternative string) string {
 	envStr := os.Getenv(envKey)
 	if envStr == "" {
-		return alternative
+		envStr = alternative
 	}
+	effectiveConfig[envKey] = envStr
 	return envStr
 }
 
@@ -82,17 +144,54 @@ func requestDurationTrack(start time.Time) {
 	requestDurationHist.Observe(elapsed)
 }
 
-func httpTest(httpClient *http.Client) {
+// sendRequest sends req, records it in the request metrics and copies the
+// decoded response body to body. The error is either the transport error or
+// the error decoding the body.
+func sendRequest(httpClient *http.Client, req *http.Request, body io.Writer) (*http.Response, error) {
 	now := time.Now()
-	resp, err := httpClient.Get(targetUrl)
-	if err == nil {
-		defer requestDurationTrack(now)
-		httpRequests.With(statusCodeLabel(resp.StatusCode)).Inc()
-		io.Copy(ioutil.Discard, resp.Body)
-	} else {
+	if acceptEncoding != "" && req.Header.Get("Accept-Encoding") == "" {
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
 		log.Printf("Failed HTTP request: %s\n", err)
 		httpErrors.Inc()
+		return nil, err
+	}
+	defer requestDurationTrack(now)
+	defer resp.Body.Close()
+	httpRequests.With(statusCodeLabel(resp.StatusCode)).Inc()
+	encoding, err := readResponse(resp, body)
+	responseEncodings.With(prometheus.Labels{"encoding": encoding}).Inc()
+	if err != nil {
+		log.Printf("Failed to decode %s response: %s\n", encoding, err)
+		decodeErrors.With(prometheus.Labels{"encoding": encoding}).Inc()
+	}
+	return resp, err
+}
+
+// doRequest sends a request that is not part of the load, like those of
+// setup, init and teardown. It is only counted in hookRequests.
+func doRequest(httpClient *http.Client, req *http.Request, body io.Writer) (*http.Response, error) {
+	if acceptEncoding != "" && req.Header.Get("Accept-Encoding") == "" {
+		req.Header.Set("Accept-Encoding", acceptEncoding)
 	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	hookRequests.With(statusCodeLabel(resp.StatusCode)).Inc()
+	_, err = readResponse(resp, body)
+	return resp, err
+}
+
+func httpTest(httpClient *http.Client) {
+	req, err := http.NewRequest("GET", targetUrl, nil)
+	if err != nil {
+		log.Panic(err)
+	}
+	sendRequest(httpClient, req, ioutil.Discard)
 }
 
 func runTest(testFunc func(), ticks chan time.Time) {
@@ -101,8 +200,8 @@ func runTest(testFunc func(), ticks chan time.Time) {
 	}
 }
 
-func startTicking(tickers []chan time.Time) {
-	timeout := time.After(testTime)
+func startTicking(tickers []chan time.Time, duration time.Duration) {
+	timeout := time.After(duration)
 	tick := time.Tick(minTimeBetweenReqs)
 	for {
 		select {
@@ -116,13 +215,16 @@ func startTicking(tickers []chan time.Time) {
 	}
 }
 
-func dumpMetricsAsJson(filepath string, registry *prometheus.Registry) (err error) {
+func dumpMetricsAsJson(filepath string, registry *prometheus.Registry, metadata runMetadata) (err error) {
 	family, err := registry.Gather()
 	if err != nil {
 		return
 	}
 
-	bytes, err := json.Marshal(family)
+	bytes, err := json.Marshal(map[string]interface{}{
+		"metadata": metadata,
+		"metrics":  family,
+	})
 	if err != nil {
 		return
 	}
@@ -132,10 +234,62 @@ func dumpMetricsAsJson(filepath string, registry *prometheus.Registry) (err erro
 	return
 }
 
+func writeJson(filepath string, v interface{}) error {
+	bytes, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath, bytes, 0644)
+}
+
+func runExperiment(tickers []chan time.Time, registry *prometheus.Registry) bool {
+	e, err := loadExperiment(experimentFile)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	log.Printf("Experiment %q started\n", e.Name)
+	report := e.run(tickers, registry)
+	log.Printf("Experiment %q ended, passed: %t\n", e.Name, report.Passed)
+
+	if experimentReportFile != "" {
+		log.Printf("Writing experiment report to %s\n", experimentReportFile)
+		if err := writeJson(experimentReportFile, report); err != nil {
+			log.Panic(err)
+		}
+	} else {
+		bytes, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(bytes))
+	}
+	return report.Passed
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "history":
+			runHistory(os.Args[2:])
+			return
+		case "compare":
+			runCompare(os.Args[2:])
+			return
+		case "import-har":
+			runImportHar(os.Args[2:])
+			return
+		case "import-curl":
+			runImportCurl(os.Args[2:])
+			return
+		case "import-postman":
+			runImportPostman(os.Args[2:])
+			return
+		}
+	}
+
 	// Init Prometheus
 	registry := prometheus.NewRegistry()
-	registry.MustRegister(requestDuration, requestDurationHist, httpRequests, httpErrors)
+	registry.MustRegister(requestDuration, requestDurationHist, httpRequests, httpErrors,
+		responseEncodings, decodeErrors, scriptChecks, scriptErrors, openDropped,
+		sessionsStarted, activeSessions, hookRequests)
 
 	// Init HTTP transport and client
 	defaultRoundTripper := http.DefaultTransport
@@ -157,24 +311,159 @@ func main() {
 		tickers[i] = make(chan time.Time)
 	}
 
-	// Launch testers
+	// Launch testers, running the script or scenario when one is given
+	if scriptFile != "" && scenarioFile != "" {
+		log.Panic("SCRIPT and SCENARIO_FILE cannot be used together")
+	}
+	// Setup runs before the VUs are created, which may run their init hooks
+	var teardown func() error
 	testFunc := func() {
 		httpTest(httpClient)
 	}
-	for _, ticker := range tickers {
-		go runTest(testFunc, ticker)
+	newVU := func(id int) (func(), error) {
+		return testFunc, nil
+	}
+	stateful := false
+	if scriptFile != "" {
+		script, err := newScriptRunner(scriptFile, httpClient, registry)
+		if err != nil {
+			log.Panic(err)
+		}
+		if err := script.setup(); err != nil {
+			log.Panic(err)
+		}
+		teardown = script.teardown
+		newVU = script.newVU
+		stateful = true
+	}
+	if scenarioFile != "" {
+		s, err := loadScenario(scenarioFile)
+		if err != nil {
+			log.Panic(err)
+		}
+		if err := s.setup(httpClient); err != nil {
+			log.Panic(err)
+		}
+		teardown = func() error {
+			return s.teardown(httpClient)
+		}
+		newVU = func(id int) (func(), error) {
+			return s.newVU(httpClient)
+		}
+		stateful = len(s.Init) > 0
+	}
+	vus := make([]func(), concurrencyFactor)
+	for i := range vus {
+		var err error
+		if vus[i], err = newVU(i + 1); err != nil {
+			log.Panic(err)
+		}
+		go runTest(vus[i], tickers[i])
+	}
+	// Open model arrivals run on any VU, or on a free one when VUs hold state
+	var iteration func()
+	if stateful {
+		iteration = vuPool(vus)
+	} else {
+		iteration, _ = newVU(0)
+	}
+
+	// Describe the run
+	metadata, err := newRunMetadata(time.Now())
+	if err != nil {
+		log.Panic(err)
+	}
+	log.Printf("Starting %s\n", metadata)
+
+	// Start following the run on both sides
+	scraper, err := startScraper(serverMetricsUrls, scrapeInterval, registry)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	// Start the test, the experiment or the replay when one is declared
+	passed := true
+	if experimentFile != "" {
+		passed = runExperiment(tickers, registry)
+	} else if replayFile != "" {
+		log.Printf("Replay of %s started\n", replayFile)
+		if err := runReplay(httpClient, replayFile, replayFormat, replaySpeed, replayAmplify, maxInFlight); err != nil {
+			log.Panic(err)
+		}
+		log.Println("Replay ended")
+	} else if rateFile != "" || arrivalRate > 0 {
+		curve := constantRate(arrivalRate, testTime)
+		if rateFile != "" {
+			duration, err := time.ParseDuration(rateDuration)
+			if err != nil && rateDuration != "" {
+				log.Panic(err)
+			}
+			if curve, err = loadRateCurve(rateFile, duration, rateScale); err != nil {
+				log.Panic(err)
+			}
+		}
+		process, err := parseArrivalProcess(arrivalProcessSpec)
+		if err != nil {
+			log.Panic(err)
+		}
+		log.Println("Test started")
+		runRateCurve(curve, process, iteration)
+		log.Println("Test ended")
+	} else if sessionLength != "" {
+		length, err := parseDistribution(sessionLength)
+		if err != nil {
+			log.Panic(err)
+		}
+		thinkTime, err := parseDistribution(sessionThinkTime)
+		if err != nil {
+			log.Panic(err)
+		}
+		process, err := parseArrivalProcess(arrivalProcessSpec)
+		if err != nil {
+			log.Panic(err)
+		}
+		log.Println("Test started")
+		sessionRunner{len(vus), newVU, length, thinkTime, time.Now().Add(testTime)}.run(sessionRate, process)
+		log.Println("Test ended")
+	} else {
+		log.Println("Test started")
+		startTicking(tickers, testTime)
+		log.Println("Test ended")
 	}
 
-	// Start the test
-	log.Println("Test started")
-	startTicking(tickers)
-	log.Println("Test ended")
+	if teardown != nil {
+		if err := teardown(); err != nil {
+			log.Printf("%s\n", err)
+			passed = false
+		}
+	}
+	report, err := scraper.finish()
+	if err != nil {
+		log.Panic(err)
+	}
+	metadata.End = report.End
+	report.Metadata = &metadata
+	for _, d := range report.Discrepancies {
+		log.Printf("Discrepancy: %s\n", d)
+	}
+	if reportFile != "" {
+		log.Printf("Writing report to %s\n", reportFile)
+		if err := writeJson(reportFile, report); err != nil {
+			log.Panic(err)
+		}
+	}
+	if historyFile != "" {
+		log.Printf("Appending run to %s\n", historyFile)
+		if err := appendHistory(historyFile, newHistoryEntry(report)); err != nil {
+			log.Panic(err)
+		}
+	}
 
 	// Push to gateway
 	if pushGatewayAddress != "" {
 		log.Println("Pushing metrics")
 		if err := push.AddFromGatherer(
-			"load_test", nil,
+			"load_test", metadata.groupingLabels(),
 			pushGatewayAddress,
 			registry,
 		); err != nil {
@@ -186,10 +475,13 @@ func main() {
 	// Dump metrics to file
 	if metricsOutputFile != "" {
 		log.Printf("Dumping metrics to %s\n", metricsOutputFile)
-		if err := dumpMetricsAsJson(metricsOutputFile, registry); err != nil {
+		if err := dumpMetricsAsJson(metricsOutputFile, registry, metadata); err != nil {
 			log.Panic(err)
 		}
 	}
 
 	log.Println("Exiting")
+	if !passed {
+		os.Exit(1)
+	}
 }
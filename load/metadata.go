@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+var labelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+type hostInfo struct {
+	Hostname  string `json:"hostname"`
+	OS        string `json:"os"`
+	Arch      string `json:"arch"`
+	CPUs      int    `json:"cpus"`
+	GoVersion string `json:"go_version"`
+}
+
+// runMetadata ties the results of a run to what was tested, how and from where.
+type runMetadata struct {
+	RunID         string            `json:"run_id"`
+	Scenario      string            `json:"scenario"`
+	Start         time.Time         `json:"start"`
+	End           time.Time         `json:"end"`
+	TargetURL     string            `json:"target_url"`
+	TargetVersion string            `json:"target_version"`
+	Config        map[string]string `json:"config"`
+	Host          hostInfo          `json:"host"`
+	Tags          map[string]string `json:"tags,omitempty"`
+}
+
+// parseTags reads TAGS, a comma separated list of name=value pairs. Names
+// must be valid Prometheus label names since they group pushed metrics.
+func parseTags(s string) (map[string]string, error) {
+	tags := map[string]string{}
+	for _, pair := range splitList(s) {
+		parts := strings.SplitN(pair, "=", 2)
+		name := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || !labelName.MatchString(name) || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("TAGS: %q is not a name=value pair with a valid label name", pair)
+		}
+		if name == "run_id" || name == "target_version" || name == "job" {
+			return nil, fmt.Errorf("TAGS: %s is reserved", name)
+		}
+		tags[name] = strings.TrimSpace(parts[1])
+	}
+	return tags, nil
+}
+
+func newRunID(start time.Time) string {
+	b := make([]byte, 3)
+	rand.Read(b)
+	return start.UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(b)
+}
+
+// fetchTargetVersion asks failserver for the commit it was built from.
+func fetchTargetVersion(target string) (string, error) {
+	base, err := url.Parse(target)
+	if err != nil {
+		return "", err
+	}
+	versionUrl := base.ResolveReference(&url.URL{Path: "/version"}).String()
+	resp, err := sideClient.Get(versionUrl)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("GET %s: %s", versionUrl, resp.Status)
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+// defaultScenario names a run after its script or scenario file, so that runs
+// of different files don't share a history.
+func defaultScenario() string {
+	for _, file := range []string{scriptFile, scenarioFile} {
+		if file != "" {
+			base := filepath.Base(file)
+			return strings.TrimSuffix(base, filepath.Ext(base))
+		}
+	}
+	return "default"
+}
+
+func newRunMetadata(start time.Time) (runMetadata, error) {
+	tags, err := parseTags(getStringEnv("TAGS", ""))
+	if err != nil {
+		return runMetadata{}, err
+	}
+	hostname, _ := os.Hostname()
+	m := runMetadata{
+		RunID:     getStringEnv("RUN_ID", newRunID(start)),
+		Scenario:  getStringEnv("SCENARIO", defaultScenario()),
+		Start:     start,
+		TargetURL: targetUrl,
+		Config:    effectiveConfig,
+		Host: hostInfo{
+			Hostname:  hostname,
+			OS:        runtime.GOOS,
+			Arch:      runtime.GOARCH,
+			CPUs:      runtime.NumCPU(),
+			GoVersion: runtime.Version(),
+		},
+		Tags: tags,
+	}
+
+	if m.TargetVersion, err = fetchTargetVersion(targetUrl); err != nil {
+		log.Printf("Failed to fetch the target version: %s\n", err)
+		m.TargetVersion = "unknown"
+	}
+	return m, nil
+}
+
+// groupingLabels are the Pushgateway grouping labels of the run.
+func (m runMetadata) groupingLabels() map[string]string {
+	labels := map[string]string{
+		"run_id":         m.RunID,
+		"target_version": m.TargetVersion,
+	}
+	for name, value := range m.Tags {
+		labels[name] = value
+	}
+	return labels
+}
+
+func (m runMetadata) String() string {
+	tags := make([]string, 0, len(m.Tags))
+	for name, value := range m.Tags {
+		tags = append(tags, name+"="+value)
+	}
+	sort.Strings(tags)
+	return fmt.Sprintf("run %s of %s against %s (version %s) tags [%s]", m.RunID, m.Scenario, m.TargetURL, m.TargetVersion, strings.Join(tags, ","))
+}
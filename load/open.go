@@ -0,0 +1,67 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sync"
+	"time"
+)
+
+var openDropped = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "open_model_dropped_total",
+		Help: "Number of arrivals dropped because too many requests were in flight",
+	},
+)
+
+// dispatcher starts every arrival at its planned moment in a goroutine of
+// its own, so slow responses never delay the arrivals after them. Arrivals
+// finding maxInFlight requests still running are dropped.
+type dispatcher struct {
+	start    time.Time
+	inFlight chan struct{}
+	wg       sync.WaitGroup
+}
+
+func newDispatcher(maxInFlight int) *dispatcher {
+	return &dispatcher{start: time.Now(), inFlight: make(chan struct{}, maxInFlight)}
+}
+
+// at runs f offset after the dispatcher was created. Calls must come in
+// the order of their offsets.
+func (d *dispatcher) at(offset time.Duration, f func()) {
+	time.Sleep(time.Until(d.start.Add(offset)))
+	select {
+	case d.inFlight <- struct{}{}:
+	default:
+		openDropped.Inc()
+		return
+	}
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		defer func() { <-d.inFlight }()
+		f()
+	}()
+}
+
+func (d *dispatcher) wait() {
+	d.wg.Wait()
+}
+
+// vuPool runs each arrival on a VU that is not busy, dropping it when all
+// are. Script VUs cannot run two iterations at once.
+func vuPool(vus []func()) func() {
+	free := make(chan func(), len(vus))
+	for _, vu := range vus {
+		free <- vu
+	}
+	return func() {
+		select {
+		case vu := <-free:
+			vu()
+			free <- vu
+		default:
+			openDropped.Inc()
+		}
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const formBoundary = "failserver-form-boundary"
+
+type postmanKeyValue struct {
+	Key      string `json:"key"`
+	Value    string `json:"value"`
+	Disabled bool   `json:"disabled"`
+	Enabled  *bool  `json:"enabled"`
+	Type     string `json:"type"`
+}
+
+func (kv postmanKeyValue) active() bool {
+	return !kv.Disabled && (kv.Enabled == nil || *kv.Enabled)
+}
+
+type postmanAuth struct {
+	Type   string            `json:"type"`
+	Bearer []postmanKeyValue `json:"bearer"`
+	Basic  []postmanKeyValue `json:"basic"`
+	APIKey []postmanKeyValue `json:"apikey"`
+}
+
+func authValue(values []postmanKeyValue, key string) string {
+	for _, kv := range values {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return ""
+}
+
+// postmanURL is either a plain string or an object with the raw URL.
+type postmanURL struct {
+	Raw string
+}
+
+func (u *postmanURL) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, &u.Raw); err == nil {
+		return nil
+	}
+	var object struct {
+		Raw string `json:"raw"`
+	}
+	if err := json.Unmarshal(b, &object); err != nil {
+		return err
+	}
+	u.Raw = object.Raw
+	return nil
+}
+
+type postmanItem struct {
+	Name    string        `json:"name"`
+	Item    []postmanItem `json:"item"`
+	Auth    *postmanAuth  `json:"auth"`
+	Request *struct {
+		Method string            `json:"method"`
+		URL    postmanURL        `json:"url"`
+		Header []postmanKeyValue `json:"header"`
+		Auth   *postmanAuth      `json:"auth"`
+		Body   *struct {
+			Mode       string            `json:"mode"`
+			Raw        string            `json:"raw"`
+			URLEncoded []postmanKeyValue `json:"urlencoded"`
+			FormData   []postmanKeyValue `json:"formdata"`
+			GraphQL    *struct {
+				Query     string `json:"query"`
+				Variables string `json:"variables"`
+			} `json:"graphql"`
+			Options struct {
+				Raw struct {
+					Language string `json:"language"`
+				} `json:"raw"`
+			} `json:"options"`
+		} `json:"body"`
+	} `json:"request"`
+}
+
+type postmanCollection struct {
+	Info struct {
+		Name   string `json:"name"`
+		Schema string `json:"schema"`
+	} `json:"info"`
+	Item     []postmanItem     `json:"item"`
+	Auth     *postmanAuth      `json:"auth"`
+	Variable []postmanKeyValue `json:"variable"`
+}
+
+type postmanEnvironment struct {
+	Name   string            `json:"name"`
+	Values []postmanKeyValue `json:"values"`
+}
+
+// applyAuth sets the header for the auth types that map onto one.
+func applyAuth(auth *postmanAuth, headers map[string]string) error {
+	if auth == nil {
+		return nil
+	}
+	switch auth.Type {
+	case "noauth", "":
+	case "bearer":
+		headers["Authorization"] = "Bearer " + authValue(auth.Bearer, "token")
+	case "basic":
+		credentials := authValue(auth.Basic, "username") + ":" + authValue(auth.Basic, "password")
+		if strings.Contains(credentials, "{{") {
+			return fmt.Errorf("basic auth with variables cannot be encoded ahead of time, set an Authorization header instead")
+		}
+		headers["Authorization"] = "Basic " + base64.StdEncoding.EncodeToString([]byte(credentials))
+	case "apikey":
+		if in := authValue(auth.APIKey, "in"); in != "" && in != "header" {
+			return fmt.Errorf("apikey auth in %s is not supported", in)
+		}
+		headers[authValue(auth.APIKey, "key")] = authValue(auth.APIKey, "value")
+	default:
+		return fmt.Errorf("%s auth is not supported", auth.Type)
+	}
+	return nil
+}
+
+func convertPostmanItem(item postmanItem, auth *postmanAuth) (scenarioRequest, error) {
+	req := item.Request
+	r := scenarioRequest{Name: item.Name, Method: strings.ToUpper(req.Method), URL: req.URL.Raw, Headers: map[string]string{}}
+	if r.Method == "" {
+		r.Method = "GET"
+	}
+	if req.Auth != nil {
+		auth = req.Auth
+	}
+	if err := applyAuth(auth, r.Headers); err != nil {
+		return r, err
+	}
+	for _, h := range req.Header {
+		if h.active() {
+			r.Headers[h.Key] = h.Value
+		}
+	}
+
+	if body := req.Body; body != nil {
+		contentType := ""
+		switch body.Mode {
+		case "raw":
+			r.Body = body.Raw
+			if body.Options.Raw.Language == "json" {
+				contentType = "application/json"
+			}
+		case "urlencoded":
+			var pairs []string
+			for _, kv := range body.URLEncoded {
+				if kv.active() {
+					pairs = append(pairs, url.QueryEscape(kv.Key)+"="+url.QueryEscape(kv.Value))
+				}
+			}
+			r.Body = strings.Join(pairs, "&")
+			contentType = "application/x-www-form-urlencoded"
+		case "graphql":
+			if body.GraphQL == nil {
+				return r, fmt.Errorf("graphql body without a graphql object")
+			}
+			payload := map[string]interface{}{"query": body.GraphQL.Query}
+			if body.GraphQL.Variables != "" {
+				payload["variables"] = json.RawMessage(body.GraphQL.Variables)
+			}
+			data, err := json.Marshal(payload)
+			if err != nil {
+				return r, err
+			}
+			r.Body = string(data)
+			contentType = "application/json"
+		case "formdata":
+			// a fixed boundary keeps the scenario the same on every import
+			var buf bytes.Buffer
+			form := multipart.NewWriter(&buf)
+			form.SetBoundary(formBoundary)
+			for _, kv := range body.FormData {
+				if !kv.active() {
+					continue
+				}
+				if kv.Type == "file" {
+					return r, fmt.Errorf("form field %q uploads a file, which is not supported", kv.Key)
+				}
+				if err := form.WriteField(kv.Key, kv.Value); err != nil {
+					return r, err
+				}
+			}
+			if err := form.Close(); err != nil {
+				return r, err
+			}
+			r.Body = buf.String()
+			contentType = form.FormDataContentType()
+		case "", "none":
+		default:
+			return r, fmt.Errorf("%s bodies are not supported", body.Mode)
+		}
+		if _, ok := r.Headers["Content-Type"]; !ok && contentType != "" {
+			r.Headers["Content-Type"] = contentType
+		}
+	}
+	if len(r.Headers) == 0 {
+		r.Headers = nil
+	}
+	return r, nil
+}
+
+// convertPostman turns a collection into a scenario with a page per folder.
+// Requests outside of folders go to a page named after the collection, and
+// auth is inherited from the enclosing folders and the collection.
+func convertPostman(c postmanCollection, env *postmanEnvironment, absolute bool) (scenario, error) {
+	s := scenario{Name: c.Info.Name, Variables: map[string]string{}}
+	for _, kv := range c.Variable {
+		if kv.active() {
+			s.Variables[kv.Key] = kv.Value
+		}
+	}
+	if env != nil {
+		for _, kv := range env.Values {
+			if kv.active() {
+				s.Variables[kv.Key] = kv.Value
+			}
+		}
+	}
+	if len(s.Variables) == 0 {
+		s.Variables = nil
+	}
+
+	pages := map[string]int{}
+	var walk func(items []postmanItem, folder string, auth *postmanAuth) error
+	walk = func(items []postmanItem, folder string, auth *postmanAuth) error {
+		for _, item := range items {
+			itemAuth := auth
+			if item.Auth != nil {
+				itemAuth = item.Auth
+			}
+			if item.Request == nil {
+				name := item.Name
+				if folder != "" {
+					name = folder + " / " + item.Name
+				}
+				if err := walk(item.Item, name, itemAuth); err != nil {
+					return err
+				}
+				continue
+			}
+
+			r, err := convertPostmanItem(item, itemAuth)
+			if err != nil {
+				return fmt.Errorf("%s: %s", item.Name, err)
+			}
+			if !absolute {
+				r.URL = relativeURL(r.URL)
+			}
+			pageName := folder
+			if pageName == "" {
+				pageName = c.Info.Name
+			}
+			i, ok := pages[pageName]
+			if !ok {
+				i = len(s.Pages)
+				pages[pageName] = i
+				s.Pages = append(s.Pages, page{Name: pageName})
+			}
+			s.Pages[i].Requests = append(s.Pages[i].Requests, r)
+		}
+		return nil
+	}
+	if err := walk(c.Item, "", c.Auth); err != nil {
+		return s, err
+	}
+	return s, nil
+}
+
+func readJSONFile(path string, v interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	return nil
+}
+
+// runImportPostman implements the import-postman command.
+func runImportPostman(args []string) {
+	flags := flag.NewFlagSet("import-postman", flag.ExitOnError)
+	envPath := flags.String("environment", "", "Postman environment file whose values override the collection variables")
+	absolute := flags.Bool("absolute", false, "keep URLs absolute instead of resolving them against TARGET_URL")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: load import-postman [flags] COLLECTION.json")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	var c postmanCollection
+	if err := readJSONFile(flags.Arg(0), &c); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if c.Info.Schema != "" && !strings.Contains(c.Info.Schema, "v2.1") {
+		fmt.Fprintf(os.Stderr, "%s: only Postman v2.1 collections are supported, got %s\n", flags.Arg(0), c.Info.Schema)
+		os.Exit(2)
+	}
+	var env *postmanEnvironment
+	if *envPath != "" {
+		env = &postmanEnvironment{}
+		if err := readJSONFile(*envPath, env); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
+
+	s, err := convertPostman(c, env, *absolute)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", flags.Arg(0), err)
+		os.Exit(2)
+	}
+	writeScenario(s)
+}
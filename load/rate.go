@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type rateSample struct {
+	Time time.Time
+	RPS  float64
+}
+
+// rateStep holds rps from start until the next step.
+type rateStep struct {
+	start time.Duration
+	rps   float64
+}
+
+// rateCurve is an arrival rate that changes over the run.
+type rateCurve struct {
+	steps []rateStep
+	end   time.Duration
+}
+
+func parseSampleTime(s string) (time.Time, error) {
+	if seconds, err := strconv.ParseFloat(s, 64); err == nil {
+		return parseLogTime(seconds)
+	}
+	return time.Parse(time.RFC3339Nano, s)
+}
+
+// readRateCSV reads timestamp,rps rows. A header row is skipped.
+func readRateCSV(data []byte) ([]rateSample, error) {
+	reader := csv.NewReader(strings.NewReader(string(data)))
+	reader.TrimLeadingSpace = true
+	reader.Comment = '#'
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	var samples []rateSample
+	for i, row := range rows {
+		if len(row) < 2 {
+			return nil, fmt.Errorf("line %d: expected timestamp,rps", i+1)
+		}
+		t, err := parseSampleTime(row[0])
+		if err == nil {
+			var rps float64
+			if rps, err = strconv.ParseFloat(row[1], 64); err == nil {
+				samples = append(samples, rateSample{t, rps})
+				continue
+			}
+		}
+		if i > 0 {
+			return nil, fmt.Errorf("line %d: %s", i+1, err)
+		}
+	}
+	return samples, nil
+}
+
+// readPrometheusRange reads the JSON answer of a range query such as
+// sum(rate(http_requests_total[1m])). Series are added up.
+func readPrometheusRange(data []byte) ([]rateSample, error) {
+	var answer struct {
+		Status string `json:"status"`
+		Data   struct {
+			ResultType string `json:"resultType"`
+			Result     []struct {
+				Values [][2]interface{} `json:"values"`
+			} `json:"result"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(data, &answer); err != nil {
+		return nil, err
+	}
+	if answer.Status != "success" || answer.Data.ResultType != "matrix" {
+		return nil, fmt.Errorf("expected a successful range query with a matrix result")
+	}
+	sums := map[float64]float64{}
+	for _, series := range answer.Data.Result {
+		for _, pair := range series.Values {
+			ts, ok := pair[0].(float64)
+			value, isString := pair[1].(string)
+			if !ok || !isString {
+				return nil, fmt.Errorf("bad sample %v", pair)
+			}
+			rps, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return nil, err
+			}
+			sums[ts] += rps
+		}
+	}
+	var samples []rateSample
+	for ts, rps := range sums {
+		t, _ := parseLogTime(ts)
+		samples = append(samples, rateSample{t, rps})
+	}
+	return samples, nil
+}
+
+// loadRateCurve reads the samples of path and compresses them into duration,
+// keeping the rates themselves multiplied by scale. Each sample holds until
+// the next one, the last one only marks the end. A zero duration replays
+// the samples in real time.
+func loadRateCurve(path string, duration time.Duration, scale float64) (rateCurve, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return rateCurve{}, err
+	}
+	var samples []rateSample
+	if strings.HasPrefix(strings.TrimSpace(string(data)), "{") {
+		samples, err = readPrometheusRange(data)
+	} else {
+		samples, err = readRateCSV(data)
+	}
+	if err != nil {
+		return rateCurve{}, fmt.Errorf("%s: %s", path, err)
+	}
+	if len(samples) < 2 {
+		return rateCurve{}, fmt.Errorf("%s: at least two samples are needed", path)
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i].Time.Before(samples[j].Time) })
+
+	span := samples[len(samples)-1].Time.Sub(samples[0].Time)
+	if span <= 0 {
+		return rateCurve{}, fmt.Errorf("%s: samples do not span any time", path)
+	}
+	compression := 1.0
+	if duration > 0 {
+		compression = float64(span) / float64(duration)
+	}
+	var c rateCurve
+	for _, s := range samples {
+		if s.RPS < 0 || scale < 0 {
+			return rateCurve{}, fmt.Errorf("%s: negative rate", path)
+		}
+		c.steps = append(c.steps, rateStep{
+			start: time.Duration(float64(s.Time.Sub(samples[0].Time)) / compression),
+			rps:   s.RPS * scale,
+		})
+	}
+	c.end = c.steps[len(c.steps)-1].start
+	c.steps = c.steps[:len(c.steps)-1]
+	return c, nil
+}
+
+// advance returns the moment after t by which area arrivals are expected,
+// and false when the curve ends first.
+func (c rateCurve) advance(t time.Duration, area float64) (time.Duration, bool) {
+	i := sort.Search(len(c.steps), func(i int) bool { return c.steps[i].start > t }) - 1
+	for ; i < len(c.steps); i++ {
+		end := c.end
+		if i+1 < len(c.steps) {
+			end = c.steps[i+1].start
+		}
+		if rps := c.steps[i].rps; rps > 0 {
+			if need := time.Duration(area / rps * float64(time.Second)); t+need <= end {
+				return t + need, true
+			}
+			area -= rps * (end - t).Seconds()
+		}
+		t = end
+	}
+	return 0, false
+}
+
+func (c rateCurve) peak() float64 {
+	peak := 0.0
+	for _, s := range c.steps {
+		if s.rps > peak {
+			peak = s.rps
+		}
+	}
+	return peak
+}
+
+// runRateCurve starts iterations at the rate of the curve until it ends,
+// spaced by the arrival process.
+func runRateCurve(c rateCurve, process arrivalProcess, iteration func()) {
+	log.Printf("Following a rate curve of %d steps for %s, peaking at %.1f rps\n", len(c.steps), c.end, c.peak())
+	d := newDispatcher(maxInFlight)
+	t := time.Duration(0)
+	for {
+		gap, batch := process()
+		var ok bool
+		if t, ok = c.advance(t, gap); !ok {
+			break
+		}
+		for i := 0; i < batch; i++ {
+			d.at(t, iteration)
+		}
+	}
+	d.wait()
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReadRateCSV(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    []rateSample
+		wantErr bool
+	}{
+		{
+			name: "header and comments",
+			data: "time,rps\n# night\n0, 1.5\n60,3\n",
+			want: []rateSample{{time.Unix(0, 0), 1.5}, {time.Unix(60, 0), 3}},
+		},
+		{
+			name: "RFC 3339 and extra columns",
+			data: "2026-10-16T10:00:00Z,2,x\n2026-10-16T10:01:00Z,4,y\n",
+			want: []rateSample{
+				{time.Date(2026, 10, 16, 10, 0, 0, 0, time.UTC), 2},
+				{time.Date(2026, 10, 16, 10, 1, 0, 0, time.UTC), 4},
+			},
+		},
+		{name: "empty", data: ""},
+		{name: "bad rate after the header", data: "time,rps\n0,1\n60,lots\n", wantErr: true},
+		{name: "bad time after the header", data: "0,1\nnoon,1\n", wantErr: true},
+		{name: "one column", data: "0\n", wantErr: true},
+		{name: "ragged rows", data: "0,1\n60,1,2\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := readRateCSV([]byte(tt.data))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error %v, want error: %t", tt.name, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if !got[i].Time.Equal(tt.want[i].Time) || got[i].RPS != tt.want[i].RPS {
+				t.Errorf("%s: sample %d: got %v, want %v", tt.name, i, got[i], tt.want[i])
+			}
+		}
+	}
+}
+
+func TestReadPrometheusRange(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    map[int64]float64
+		wantErr bool
+	}{
+		{
+			name: "series are added up",
+			data: `{"status": "success", "data": {"resultType": "matrix", "result": [
+			  {"metric": {"pod": "a"}, "values": [[100, "1"], [160, "2.5"]]},
+			  {"metric": {"pod": "b"}, "values": [[100, "3"]]}]}}`,
+			want: map[int64]float64{100: 4, 160: 2.5},
+		},
+		{name: "error", data: `{"status": "error", "error": "bad query"}`, wantErr: true},
+		{name: "vector", data: `{"status": "success", "data": {"resultType": "vector", "result": []}}`, wantErr: true},
+		{
+			name:    "numeric value",
+			data:    `{"status": "success", "data": {"resultType": "matrix", "result": [{"values": [[100, 1]]}]}}`,
+			wantErr: true,
+		},
+		{
+			name:    "not a number",
+			data:    `{"status": "success", "data": {"resultType": "matrix", "result": [{"values": [[100, "NaNa"]]}]}}`,
+			wantErr: true,
+		},
+		{name: "not JSON", data: `{"status"`, wantErr: true},
+	}
+	for _, tt := range tests {
+		samples, err := readPrometheusRange([]byte(tt.data))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error %v, want error: %t", tt.name, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		got := map[int64]float64{}
+		for _, s := range samples {
+			got[s.Time.Unix()] = s.RPS
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLoadRateCurve(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name     string
+		data     string
+		duration time.Duration
+		scale    float64
+		want     rateCurve
+		wantErr  bool
+	}{
+		{
+			name:  "real time",
+			data:  "0,1\n60,2\n120,0\n",
+			scale: 1,
+			want:  rateCurve{steps: []rateStep{{0, 1}, {time.Minute, 2}}, end: 2 * time.Minute},
+		},
+		{
+			name:     "compressed, scaled and sorted",
+			data:     "3600,4\n0,1\n7200,0\n",
+			duration: time.Minute,
+			scale:    10,
+			want:     rateCurve{steps: []rateStep{{0, 10}, {30 * time.Second, 40}}, end: time.Minute},
+		},
+		{name: "one sample", data: "0,1\n", scale: 1, wantErr: true},
+		{name: "no span", data: "0,1\n0,2\n", scale: 1, wantErr: true},
+		{name: "negative rate", data: "0,-1\n60,1\n", scale: 1, wantErr: true},
+		{name: "negative scale", data: "0,1\n60,1\n", scale: -1, wantErr: true},
+	}
+	for i, tt := range tests {
+		path := filepath.Join(dir, string(rune('a'+i))+".csv")
+		if err := ioutil.WriteFile(path, []byte(tt.data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := loadRateCurve(path, tt.duration, tt.scale)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error %v, want error: %t", tt.name, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+	if _, err := loadRateCurve(filepath.Join(dir, "missing.csv"), 0, 1); err == nil {
+		t.Error("a missing file was accepted")
+	}
+}
+
+func TestRateCurveAdvance(t *testing.T) {
+	// 10 rps for a second, nothing for a second, then 20 rps for a second
+	c := rateCurve{steps: []rateStep{{0, 10}, {time.Second, 0}, {2 * time.Second, 20}}, end: 3 * time.Second}
+	ms := time.Millisecond
+	tests := []struct {
+		t      time.Duration
+		area   float64
+		want   time.Duration
+		wantOk bool
+	}{
+		{0, 0, 0, true},
+		{0, 5, 500 * ms, true},
+		{0, 10, time.Second, true},
+		{0, 11, 2050 * ms, true},
+		{900 * ms, 2, 2050 * ms, true},
+		{1500 * ms, 1, 2050 * ms, true},
+		{time.Second, 1, 2050 * ms, true},
+		{2900 * ms, 2, 3 * time.Second, true},
+		{2900 * ms, 3, 0, false},
+		{3 * time.Second, 0.1, 0, false},
+		{0, 31, 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := c.advance(tt.t, tt.area)
+		if ok != tt.wantOk || (ok && (got-tt.want > time.Microsecond || tt.want-got > time.Microsecond)) {
+			t.Errorf("advance(%s, %g): got %s, %t, want %s, %t", tt.t, tt.area, got, ok, tt.want, tt.wantOk)
+		}
+	}
+
+	if _, ok := (rateCurve{steps: []rateStep{{0, 0}}, end: time.Minute}).advance(0, 1); ok {
+		t.Error("a curve without arrivals produced one")
+	}
+	if peak := c.peak(); peak != 20 {
+		t.Errorf("peak: got %g, want 20", peak)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// logEntry is one request read from an access log.
+type logEntry struct {
+	Time      time.Time
+	Method    string
+	Path      string
+	Referer   string
+	UserAgent string
+}
+
+// combinedLogLine matches the nginx and Apache combined format; the common
+// format is the same without referer and user agent.
+var combinedLogLine = regexp.MustCompile(`^\S+ \S+ \S+ \[([^\]]+)\] "(\S+) (\S+)[^"]*" \d{3} \S+(?: "([^"]*)" "([^"]*)")?`)
+
+func parseCombinedLine(line string) (logEntry, error) {
+	m := combinedLogLine.FindStringSubmatch(line)
+	if m == nil {
+		return logEntry{}, fmt.Errorf("not in combined log format")
+	}
+	t, err := time.Parse("02/Jan/2006:15:04:05 -0700", m[1])
+	if err != nil {
+		return logEntry{}, err
+	}
+	e := logEntry{Time: t, Method: m[2], Path: m[3], Referer: m[4], UserAgent: m[5]}
+	if e.Referer == "-" {
+		e.Referer = ""
+	}
+	if e.UserAgent == "-" {
+		e.UserAgent = ""
+	}
+	return e, nil
+}
+
+func firstField(fields map[string]interface{}, names ...string) interface{} {
+	for _, name := range names {
+		if v, ok := fields[name]; ok && v != nil && v != "" {
+			return v
+		}
+	}
+	return nil
+}
+
+// parseLogTime reads RFC 3339, combined log format or Unix seconds.
+func parseLogTime(v interface{}) (time.Time, error) {
+	switch t := v.(type) {
+	case float64:
+		sec, frac := math.Modf(t)
+		return time.Unix(int64(sec), int64(frac*1e9)), nil
+	case string:
+		if parsed, err := time.Parse(time.RFC3339Nano, t); err == nil {
+			return parsed, nil
+		}
+		if parsed, err := time.Parse("02/Jan/2006:15:04:05 -0700", t); err == nil {
+			return parsed, nil
+		}
+		if seconds, err := strconv.ParseFloat(t, 64); err == nil {
+			return parseLogTime(seconds)
+		}
+		return time.Time{}, fmt.Errorf("unknown time format %q", t)
+	}
+	return time.Time{}, fmt.Errorf("no time")
+}
+
+// parseJSONLine reads the field names used by nginx JSON log formats and
+// common logging libraries.
+func parseJSONLine(line string) (logEntry, error) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(line), &fields); err != nil {
+		return logEntry{}, err
+	}
+	t, err := parseLogTime(firstField(fields, "time", "timestamp", "@timestamp", "time_local", "time_iso8601", "msec", "ts"))
+	if err != nil {
+		return logEntry{}, err
+	}
+	e := logEntry{Time: t}
+	e.Method, _ = firstField(fields, "method", "request_method").(string)
+	e.Path, _ = firstField(fields, "path", "uri", "request_uri", "url").(string)
+	if request, ok := firstField(fields, "request").(string); ok && (e.Method == "" || e.Path == "") {
+		if parts := strings.Fields(request); len(parts) >= 2 {
+			e.Method, e.Path = parts[0], parts[1]
+		}
+	}
+	if e.Path == "" {
+		return logEntry{}, fmt.Errorf("no request path")
+	}
+	if e.Method == "" {
+		e.Method = "GET"
+	}
+	e.Referer, _ = firstField(fields, "referer", "http_referer").(string)
+	e.UserAgent, _ = firstField(fields, "user_agent", "http_user_agent").(string)
+	return e, nil
+}
+
+// readAccessLog reads every request of the log, in the order they arrived.
+// Lines that cannot be parsed are counted and skipped.
+func readAccessLog(r io.Reader, format string) ([]logEntry, int, error) {
+	var entries []logEntry
+	skipped := 0
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if format == "auto" {
+			format = "combined"
+			if strings.HasPrefix(line, "{") {
+				format = "json"
+			}
+		}
+
+		var e logEntry
+		var err error
+		switch format {
+		case "combined":
+			e, err = parseCombinedLine(line)
+		case "json":
+			e, err = parseJSONLine(line)
+		default:
+			return nil, 0, fmt.Errorf("unknown log format %q", format)
+		}
+		if err != nil {
+			skipped++
+			continue
+		}
+		entries = append(entries, e)
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Time.Before(entries[j].Time) })
+	return entries, skipped, scanner.Err()
+}
+
+// copies turns an amplification factor into a number of requests, sending
+// the fractional part with that probability.
+func copies(factor float64) int {
+	n := int(factor)
+	if rand.Float64() < factor-float64(n) {
+		n++
+	}
+	return n
+}
+
+// runReplay reproduces the requests of an access log with their original
+// inter-arrival times divided by speed, each sent amplify times on average.
+func runReplay(httpClient *http.Client, path, format string, speed, amplify float64, maxInFlight int) error {
+	if speed <= 0 || amplify < 0 {
+		return fmt.Errorf("REPLAY_SPEED must be positive and REPLAY_AMPLIFY must not be negative")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	entries, skipped, err := readAccessLog(f, format)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return fmt.Errorf("%s: no requests found", path)
+	}
+	if skipped > 0 {
+		log.Printf("Skipped %d lines of %s that could not be parsed\n", skipped, path)
+	}
+	base, err := url.Parse(targetUrl)
+	if err != nil {
+		return err
+	}
+
+	span := entries[len(entries)-1].Time.Sub(entries[0].Time)
+	log.Printf("Replaying %d requests spanning %s in %s\n", len(entries), span, time.Duration(float64(span)/speed))
+	d := newDispatcher(maxInFlight)
+	for _, e := range entries {
+		ref, err := url.Parse(relativeURL(e.Path))
+		if err != nil {
+			continue
+		}
+		target := base.ResolveReference(ref).String()
+		offset := time.Duration(float64(e.Time.Sub(entries[0].Time)) / speed)
+		for i := copies(amplify); i > 0; i-- {
+			e := e
+			d.at(offset, func() {
+				req, err := http.NewRequest(e.Method, target, nil)
+				if err != nil {
+					log.Printf("Skipping %s %s: %s\n", e.Method, target, err)
+					return
+				}
+				if e.UserAgent != "" {
+					req.Header.Set("User-Agent", e.UserAgent)
+				}
+				if e.Referer != "" {
+					req.Header.Set("Referer", e.Referer)
+				}
+				sendRequest(httpClient, req, ioutil.Discard)
+			})
+		}
+	}
+	d.wait()
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCombinedLine(t *testing.T) {
+	at := time.Date(2026, 10, 16, 10, 0, 1, 0, time.FixedZone("", 2*3600))
+	tests := []struct {
+		line    string
+		want    logEntry
+		wantErr bool
+	}{
+		{
+			line: `10.0.0.1 - - [16/Oct/2026:10:00:01 +0200] "GET /a?b=1 HTTP/1.1" 200 512 "https://ref/" "curl/8.0"`,
+			want: logEntry{Time: at, Method: "GET", Path: "/a?b=1", Referer: "https://ref/", UserAgent: "curl/8.0"},
+		},
+		{
+			line: `10.0.0.1 - frank [16/Oct/2026:10:00:01 +0200] "POST /login HTTP/1.0" 302 -`,
+			want: logEntry{Time: at, Method: "POST", Path: "/login"},
+		},
+		{
+			line: `10.0.0.1 - - [16/Oct/2026:10:00:01 +0200] "GET / HTTP/1.1" 200 1 "-" "-"`,
+			want: logEntry{Time: at, Method: "GET", Path: "/"},
+		},
+		{line: `10.0.0.1 - - [16/Oct/2026:10:00:01] "GET / HTTP/1.1" 200 1`, wantErr: true},
+		{line: `10.0.0.1 - - [16/Oct/2026:10:00:01 +0200] "-" 400 0`, wantErr: true},
+		{line: `not a log line`, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseCombinedLine(tt.line)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error %v, want error: %t", tt.line, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && (!got.Time.Equal(tt.want.Time) || got.Method != tt.want.Method || got.Path != tt.want.Path ||
+			got.Referer != tt.want.Referer || got.UserAgent != tt.want.UserAgent) {
+			t.Errorf("%s:\ngot  %+v\nwant %+v", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestParseJSONLine(t *testing.T) {
+	tests := []struct {
+		line     string
+		wantTime time.Time
+		want     logEntry
+		wantErr  bool
+	}{
+		{
+			line:     `{"time": "2026-10-16T10:00:01.5Z", "method": "PUT", "uri": "/x", "http_referer": "r", "http_user_agent": "u"}`,
+			wantTime: time.Date(2026, 10, 16, 10, 0, 1, 5e8, time.UTC),
+			want:     logEntry{Method: "PUT", Path: "/x", Referer: "r", UserAgent: "u"},
+		},
+		{
+			line:     `{"msec": 1791100801.25, "request": "DELETE /items/1 HTTP/1.1"}`,
+			wantTime: time.Unix(1791100801, 25e7),
+			want:     logEntry{Method: "DELETE", Path: "/items/1"},
+		},
+		{
+			line:     `{"ts": "1791100801", "url": "https://shop.example/a"}`,
+			wantTime: time.Unix(1791100801, 0),
+			want:     logEntry{Method: "GET", Path: "https://shop.example/a"},
+		},
+		{
+			line:     `{"@timestamp": "16/Oct/2026:10:00:01 +0000", "path": "/p", "method": ""}`,
+			wantTime: time.Date(2026, 10, 16, 10, 0, 1, 0, time.UTC),
+			want:     logEntry{Method: "GET", Path: "/p"},
+		},
+		{line: `{"time": "yesterday", "path": "/"}`, wantErr: true},
+		{line: `{"path": "/"}`, wantErr: true},
+		{line: `{"time": 1, "method": "GET"}`, wantErr: true},
+		{line: `{"time": 1, "request": "garbage"}`, wantErr: true},
+		{line: `{"time": `, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseJSONLine(tt.line)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error %v, want error: %t", tt.line, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if !got.Time.Equal(tt.wantTime) {
+			t.Errorf("%s: time %s, want %s", tt.line, got.Time, tt.wantTime)
+		}
+		got.Time = time.Time{}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s:\ngot  %+v\nwant %+v", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestReadAccessLog(t *testing.T) {
+	combined := strings.Join([]string{
+		`1.2.3.4 - - [16/Oct/2026:10:00:02 +0000] "GET /second HTTP/1.1" 200 1`,
+		``,
+		`garbage`,
+		`1.2.3.4 - - [16/Oct/2026:10:00:01 +0000] "GET /first HTTP/1.1" 200 1`,
+	}, "\n")
+	entries, skipped, err := readAccessLog(strings.NewReader(combined), "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if skipped != 1 || len(entries) != 2 || entries[0].Path != "/first" || entries[1].Path != "/second" {
+		t.Errorf("got %+v with %d skipped, want /first and /second with 1 skipped", entries, skipped)
+	}
+
+	entries, skipped, err = readAccessLog(strings.NewReader(`{"ts": 2, "path": "/b"}`+"\n"+`{"ts": 1, "path": "/a"}`), "auto")
+	if err != nil || skipped != 0 || len(entries) != 2 || entries[0].Path != "/a" {
+		t.Errorf("json: got %+v with %d skipped (%v)", entries, skipped, err)
+	}
+
+	if _, skipped, _ := readAccessLog(strings.NewReader(`{"ts": 1, "path": "/a"}`), "combined"); skipped != 1 {
+		t.Errorf("a JSON line read as combined was not skipped")
+	}
+	if _, _, err := readAccessLog(strings.NewReader("x"), "xml"); err == nil {
+		t.Error("an unknown format was accepted")
+	}
+}
+
+func TestCopies(t *testing.T) {
+	rand.Seed(1)
+	tests := []struct {
+		factor float64
+		min    int
+		max    int
+	}{
+		{0, 0, 0},
+		{1, 1, 1},
+		{2.5, 2, 3},
+		{0.25, 0, 1},
+	}
+	for _, tt := range tests {
+		const draws = 4000
+		total := 0
+		for i := 0; i < draws; i++ {
+			n := copies(tt.factor)
+			if n < tt.min || n > tt.max {
+				t.Fatalf("copies(%g) = %d, want between %d and %d", tt.factor, n, tt.min, tt.max)
+			}
+			total += n
+		}
+		if mean := float64(total) / draws; mean < tt.factor-0.05 || mean > tt.factor+0.05 {
+			t.Errorf("copies(%g): mean %f", tt.factor, mean)
+		}
+	}
+}
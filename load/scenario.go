@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	mathrand "math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// scenario is a recorded user journey: pages visited one after the other,
+// each loading its requests and followed by the user's think time.
+// {{name}} in URLs, headers and bodies is replaced by the variable of that
+// name; {{$guid}}, {{$timestamp}}, {{$isoTimestamp}} and {{$randomInt}} get a
+// new value for every request.
+//
+// Setup requests are sent once before the load and teardown requests once
+// after it, init requests once by every VU before its first page. Values
+// they extract become variables, those of setup for every VU.
+type scenario struct {
+	Name      string            `json:"name"`
+	Variables map[string]string `json:"variables,omitempty"`
+	Setup     []scenarioRequest `json:"setup,omitempty"`
+	Init      []scenarioRequest `json:"init,omitempty"`
+	Pages     []page            `json:"pages"`
+	Teardown  []scenarioRequest `json:"teardown,omitempty"`
+	base      *url.URL
+}
+
+var scenarioVariable = regexp.MustCompile(`\{\{\s*([^{}\s]+)\s*\}\}`)
+
+// expandVariables replaces the static variables in s, leaving the dynamic
+// ones for expandDynamic.
+func expandVariables(s string, variables map[string]string) (string, error) {
+	var err error
+	expanded := scenarioVariable.ReplaceAllStringFunc(s, func(match string) string {
+		name := scenarioVariable.FindStringSubmatch(match)[1]
+		if strings.HasPrefix(name, "$") {
+			return match
+		}
+		value, ok := variables[name]
+		if !ok {
+			err = fmt.Errorf("undefined variable %s", name)
+		}
+		return value
+	})
+	return expanded, err
+}
+
+func expandDynamic(s string) string {
+	if !strings.Contains(s, "{{") {
+		return s
+	}
+	return scenarioVariable.ReplaceAllStringFunc(s, func(match string) string {
+		switch scenarioVariable.FindStringSubmatch(match)[1] {
+		case "$guid":
+			b := make([]byte, 16)
+			rand.Read(b)
+			b[6] = b[6]&0x0f | 0x40
+			b[8] = b[8]&0x3f | 0x80
+			return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+		case "$timestamp":
+			return strconv.FormatInt(time.Now().Unix(), 10)
+		case "$isoTimestamp":
+			return time.Now().UTC().Format(time.RFC3339)
+		case "$randomInt":
+			return strconv.Itoa(mathrand.Intn(1001))
+		}
+		return match
+	})
+}
+
+type page struct {
+	Name      string            `json:"name"`
+	ThinkTime Duration          `json:"think_time,omitempty"`
+	Requests  []scenarioRequest `json:"requests"`
+}
+
+// scenarioRequest is one request of a page. Relative URLs are resolved
+// against TARGET_URL. Extract maps variable names to dotted paths into the
+// JSON response, e.g. "data.items.0.id"; it is only allowed outside pages.
+type scenarioRequest struct {
+	Name    string            `json:"name,omitempty"`
+	Method  string            `json:"method"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body,omitempty"`
+	Extract map[string]string `json:"extract,omitempty"`
+}
+
+func loadScenario(path string) (scenario, error) {
+	var s scenario
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return s, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&s); err != nil {
+		return s, fmt.Errorf("%s: %s", path, err)
+	}
+
+	// SCENARIO_VARIABLES overrides variables, e.g. to point baseUrl elsewhere
+	for _, pair := range splitList(getStringEnv("SCENARIO_VARIABLES", "")) {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return s, fmt.Errorf("SCENARIO_VARIABLES: %q is not a name=value pair", pair)
+		}
+		if s.Variables == nil {
+			s.Variables = map[string]string{}
+		}
+		s.Variables[strings.TrimSpace(parts[0])] = parts[1]
+	}
+	if s.base, err = url.Parse(targetUrl); err != nil {
+		return s, err
+	}
+
+	// check every request now, with the extracted variables still empty
+	known := map[string]string{}
+	for name, value := range s.Variables {
+		known[name] = value
+	}
+	for _, section := range [][]scenarioRequest{s.Setup, s.Init, s.Teardown} {
+		for _, r := range section {
+			for name := range r.Extract {
+				known[name] = ""
+			}
+		}
+	}
+	for name, section := range map[string][]scenarioRequest{"setup": s.Setup, "init": s.Init, "teardown": s.Teardown} {
+		for i, r := range section {
+			if _, err := r.expand(known); err != nil {
+				return s, fmt.Errorf("%s: %s request %d: %s", path, name, i+1, err)
+			}
+		}
+	}
+	for i, p := range s.Pages {
+		for j, r := range p.Requests {
+			if len(r.Extract) > 0 {
+				return s, fmt.Errorf("%s: page %d request %d: extract is only allowed in setup, init and teardown", path, i+1, j+1)
+			}
+			if _, err := r.expand(known); err != nil {
+				return s, fmt.Errorf("%s: page %d request %d: %s", path, i+1, j+1, err)
+			}
+		}
+	}
+	return s, nil
+}
+
+func (r scenarioRequest) expand(variables map[string]string) (scenarioRequest, error) {
+	var err error
+	if r.Method == "" {
+		r.Method = "GET"
+	}
+	if r.URL, err = expandVariables(r.URL, variables); err != nil {
+		return r, err
+	}
+	if r.Body, err = expandVariables(r.Body, variables); err != nil {
+		return r, err
+	}
+	headers := map[string]string{}
+	for name, value := range r.Headers {
+		if headers[name], err = expandVariables(value, variables); err != nil {
+			return r, err
+		}
+	}
+	r.Headers = headers
+	_, err = url.Parse(expandDynamic(r.URL))
+	return r, err
+}
+
+func (s scenario) newRequest(r scenarioRequest) (*http.Request, error) {
+	ref, err := url.Parse(expandDynamic(r.URL))
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(r.Method, s.base.ResolveReference(ref).String(), strings.NewReader(expandDynamic(r.Body)))
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range r.Headers {
+		req.Header.Set(name, expandDynamic(value))
+	}
+	return req, nil
+}
+
+// run walks through every page of the scenario once.
+func (s scenario) run(httpClient *http.Client) {
+	for _, p := range s.Pages {
+		for _, r := range p.Requests {
+			req, err := s.newRequest(r)
+			if err != nil {
+				log.Printf("Skipping %s %s: %s\n", r.Method, r.URL, err)
+				continue
+			}
+			sendRequest(httpClient, req, ioutil.Discard)
+		}
+		time.Sleep(time.Duration(p.ThinkTime))
+	}
+}
+
+// extractPath follows a dotted path of object keys and array indexes.
+func extractPath(v interface{}, path string) (string, error) {
+	for _, key := range strings.Split(path, ".") {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			v = node[key]
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return "", fmt.Errorf("no element %s in %s", key, path)
+			}
+			v = node[i]
+		default:
+			return "", fmt.Errorf("nothing at %s", path)
+		}
+	}
+	if s, ok := v.(string); ok {
+		return s, nil
+	}
+	if v == nil {
+		return "", fmt.Errorf("nothing at %s", path)
+	}
+	data, err := json.Marshal(v)
+	return string(data), err
+}
+
+// runSection sends requests in order, expanding them with variables and
+// adding what they extract to variables. Any failure stops it.
+func (s scenario) runSection(httpClient *http.Client, requests []scenarioRequest, variables map[string]string) error {
+	for i, r := range requests {
+		r, err := r.expand(variables)
+		if err != nil {
+			return fmt.Errorf("request %d: %s", i+1, err)
+		}
+		req, err := s.newRequest(r)
+		if err != nil {
+			return fmt.Errorf("request %d: %s", i+1, err)
+		}
+		var body bytes.Buffer
+		resp, err := doRequest(httpClient, req, &body)
+		if err != nil {
+			return fmt.Errorf("request %d: %s", i+1, err)
+		}
+		if resp.StatusCode >= 400 {
+			return fmt.Errorf("request %d: %s %s returned %d", i+1, r.Method, req.URL, resp.StatusCode)
+		}
+		if len(r.Extract) == 0 {
+			continue
+		}
+		var response interface{}
+		if err := json.Unmarshal(body.Bytes(), &response); err != nil {
+			return fmt.Errorf("request %d: %s", i+1, err)
+		}
+		for name, path := range r.Extract {
+			if variables[name], err = extractPath(response, path); err != nil {
+				return fmt.Errorf("request %d: %s", i+1, err)
+			}
+		}
+	}
+	return nil
+}
+
+// setup sends the setup requests, keeping what they extract as variables.
+func (s *scenario) setup(httpClient *http.Client) error {
+	if s.Variables == nil {
+		s.Variables = map[string]string{}
+	}
+	if err := s.runSection(httpClient, s.Setup, s.Variables); err != nil {
+		return fmt.Errorf("setup: %s", err)
+	}
+	return nil
+}
+
+func (s scenario) teardown(httpClient *http.Client) error {
+	if err := s.runSection(httpClient, s.Teardown, s.Variables); err != nil {
+		return fmt.Errorf("teardown: %s", err)
+	}
+	return nil
+}
+
+// newVU sends the init requests and returns a function walking through the
+// pages with the variables of this VU.
+func (s scenario) newVU(httpClient *http.Client) (func(), error) {
+	variables := map[string]string{}
+	for name, value := range s.Variables {
+		variables[name] = value
+	}
+	if err := s.runSection(httpClient, s.Init, variables); err != nil {
+		return nil, fmt.Errorf("init: %s", err)
+	}
+
+	pages := make([]page, len(s.Pages))
+	for i, p := range s.Pages {
+		pages[i] = p
+		pages[i].Requests = make([]scenarioRequest, len(p.Requests))
+		for j, r := range p.Requests {
+			var err error
+			if pages[i].Requests[j], err = r.expand(variables); err != nil {
+				return nil, err
+			}
+		}
+	}
+	s.Pages = pages
+	return func() {
+		s.run(httpClient)
+	}, nil
+}
+
+func writeScenario(s scenario) {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(s); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// serverMetrics is what the targets report about themselves on /metrics,
+// summed over all of them.
+type serverMetrics struct {
+	Codes     map[string]float64
+	Count     float64
+	Sum       float64
+	Quantiles map[float64]float64
+}
+
+func (s serverMetrics) requests() float64 {
+	var total float64
+	for _, n := range s.Codes {
+		total += n
+	}
+	return total
+}
+
+// sideClient fetches server metrics and versions. Its timeout keeps a hung
+// endpoint from stalling the run.
+var sideClient = &http.Client{Timeout: clientTimeout}
+
+func scrapeServer(url string, s *serverMetrics) error {
+	resp, err := sideClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(resp.Body)
+	if err != nil {
+		return fmt.Errorf("GET %s: %s", url, err)
+	}
+	if family, ok := families["http_requests_total"]; ok {
+		for _, m := range family.GetMetric() {
+			for _, label := range m.GetLabel() {
+				if label.GetName() == "code" {
+					s.Codes[label.GetValue()] += m.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	if family, ok := families["http_request_duration_microseconds"]; ok {
+		for _, m := range family.GetMetric() {
+			summary := m.GetSummary()
+			s.Count += float64(summary.GetSampleCount())
+			s.Sum += summary.GetSampleSum()
+			// Quantiles cannot be added up, keep the worst instance's
+			for _, q := range summary.GetQuantile() {
+				if v := q.GetValue(); !math.IsNaN(v) && v > s.Quantiles[q.GetQuantile()] {
+					s.Quantiles[q.GetQuantile()] = v
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func scrapeServers(urls []string) (serverMetrics, error) {
+	s := serverMetrics{Codes: map[string]float64{}, Quantiles: map[float64]float64{}}
+	for _, url := range urls {
+		if err := scrapeServer(url, &s); err != nil {
+			return s, err
+		}
+	}
+	return s, nil
+}
+
+// failures counts responses with a 5xx status.
+func (s serverMetrics) failures() float64 {
+	var total float64
+	for code, n := range s.Codes {
+		if c, err := strconv.Atoi(code); err == nil && c >= 500 {
+			total += n
+		}
+	}
+	return total
+}
+
+// since subtracts prev from the counters. The quantiles are kept as they
+// are: the server computes them over its own sliding window.
+func (s serverMetrics) since(prev serverMetrics) serverMetrics {
+	d := serverMetrics{
+		Codes:     map[string]float64{},
+		Count:     s.Count - prev.Count,
+		Sum:       s.Sum - prev.Sum,
+		Quantiles: s.Quantiles,
+	}
+	for code, n := range s.Codes {
+		d.Codes[code] = n - prev.Codes[code]
+	}
+	return d
+}
+
+type sideReport struct {
+	Requests        float64            `json:"requests"`
+	Codes           map[string]float64 `json:"codes"`
+	HookCodes       map[string]float64 `json:"hook_codes,omitempty"`
+	TransportErrors float64            `json:"transport_errors,omitempty"`
+	ErrorRate       float64            `json:"error_rate"`
+	MeanMs          float64            `json:"mean_ms"`
+	P50Ms           float64            `json:"p50_ms"`
+	P99Ms           float64            `json:"p99_ms"`
+}
+
+type timelineSample struct {
+	Time           time.Time `json:"time"`
+	ClientRequests float64   `json:"client_requests"`
+	ServerRequests float64   `json:"server_requests"`
+}
+
+// runReport puts what the load tester saw next to what the targets saw.
+type runReport struct {
+	Metadata      *runMetadata     `json:"metadata,omitempty"`
+	Start         time.Time        `json:"start"`
+	End           time.Time        `json:"end"`
+	Client        sideReport       `json:"client"`
+	Server        *sideReport      `json:"server,omitempty"`
+	Timeline      []timelineSample `json:"timeline,omitempty"`
+	Discrepancies []string         `json:"discrepancies,omitempty"`
+}
+
+func msOrZero(us float64) float64 {
+	if math.IsNaN(us) {
+		return 0
+	}
+	return us / 1000
+}
+
+func clientSide(s snapshot) sideReport {
+	side := sideReport{
+		Requests:        s.responses() + s.TransportErrors,
+		Codes:           s.Codes,
+		HookCodes:       s.HookCodes,
+		TransportErrors: s.TransportErrors,
+		ErrorRate:       s.errorRate(),
+		P50Ms:           msOrZero(s.quantile(0.5)),
+		P99Ms:           msOrZero(s.quantile(0.99)),
+	}
+	if s.Count > 0 {
+		side.MeanMs = s.Sum / s.Count / 1000
+	}
+	return side
+}
+
+func serverSide(s serverMetrics) *sideReport {
+	side := &sideReport{
+		Requests: s.requests(),
+		Codes:    s.Codes,
+		P50Ms:    s.Quantiles[0.5] / 1000,
+		P99Ms:    s.Quantiles[0.99] / 1000,
+	}
+	if s.Count > 0 {
+		side.MeanMs = s.Sum / s.Count / 1000
+	}
+	if side.Requests > 0 {
+		side.ErrorRate = s.failures() / side.Requests
+	}
+	return side
+}
+
+func (r *runReport) findDiscrepancies() {
+	if r.Server == nil {
+		return
+	}
+	// The server also answered the setup, init and teardown requests
+	sent := r.Client.Requests
+	for _, n := range r.Client.HookCodes {
+		sent += n
+	}
+	unseen := sent - r.Server.Requests
+	if unseen > 0 {
+		r.Discrepancies = append(r.Discrepancies, fmt.Sprintf(
+			"client sent %.0f requests but the server saw %.0f: %.0f never reached it", sent, r.Server.Requests, unseen))
+	} else if unseen < 0 {
+		r.Discrepancies = append(r.Discrepancies, fmt.Sprintf(
+			"server saw %.0f more requests than the client sent", -unseen))
+	}
+
+	codes := map[string]bool{}
+	for code := range r.Client.Codes {
+		codes[code] = true
+	}
+	for code := range r.Client.HookCodes {
+		codes[code] = true
+	}
+	for code := range r.Server.Codes {
+		codes[code] = true
+	}
+	sorted := make([]string, 0, len(codes))
+	for code := range codes {
+		sorted = append(sorted, code)
+	}
+	sort.Strings(sorted)
+	for _, code := range sorted {
+		if client, server := r.Client.Codes[code]+r.Client.HookCodes[code], r.Server.Codes[code]; client != server {
+			r.Discrepancies = append(r.Discrepancies, fmt.Sprintf(
+				"code %s: server sent %.0f, client got %.0f", code, server, client))
+		}
+	}
+
+	// Timed out requests are missing from the client's latencies only
+	if r.Client.TransportErrors == 0 && r.Server.MeanMs > r.Client.MeanMs {
+		r.Discrepancies = append(r.Discrepancies, fmt.Sprintf(
+			"server mean latency %.1fms is above the client's %.1fms", r.Server.MeanMs, r.Client.MeanMs))
+	}
+}
+
+// runScraper follows a run: it scrapes the targets when it starts, every
+// interval while the run goes on and once more when stop is closed.
+type runScraper struct {
+	urls     []string
+	gatherer prometheus.Gatherer
+	report   runReport
+	client   snapshot
+	server   serverMetrics
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func startScraper(urls []string, interval time.Duration, gatherer prometheus.Gatherer) (*runScraper, error) {
+	s := &runScraper{
+		urls:     urls,
+		gatherer: gatherer,
+		report:   runReport{Start: time.Now()},
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	var err error
+	if s.client, err = takeSnapshot(gatherer); err != nil {
+		return nil, err
+	}
+	if len(urls) > 0 {
+		if s.server, err = scrapeServers(urls); err != nil {
+			return nil, err
+		}
+	}
+
+	go func() {
+		defer close(s.done)
+		if len(urls) == 0 {
+			<-s.stop
+			return
+		}
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-tick.C:
+				s.sample()
+			}
+		}
+	}()
+	return s, nil
+}
+
+func (s *runScraper) sample() {
+	client, err := takeSnapshot(s.gatherer)
+	if err != nil {
+		log.Printf("Failed to read client metrics: %s\n", err)
+		return
+	}
+	server, err := scrapeServers(s.urls)
+	if err != nil {
+		log.Printf("Failed to scrape server metrics: %s\n", err)
+		return
+	}
+	c, sv := client.since(s.client), server.since(s.server)
+	s.report.Timeline = append(s.report.Timeline, timelineSample{
+		Time:           time.Now(),
+		ClientRequests: c.responses() + c.TransportErrors,
+		ServerRequests: sv.requests(),
+	})
+}
+
+// finish stops the scraper and builds the report. It waits for the client
+// timeout first, so requests still in flight are counted on both sides.
+func (s *runScraper) finish() (runReport, error) {
+	close(s.stop)
+	<-s.done
+	time.Sleep(clientTimeout)
+
+	client, err := takeSnapshot(s.gatherer)
+	if err != nil {
+		return s.report, err
+	}
+	s.report.End = time.Now()
+	s.report.Client = clientSide(client.since(s.client))
+	if len(s.urls) > 0 {
+		server, err := scrapeServers(s.urls)
+		if err != nil {
+			return s.report, err
+		}
+		s.report.Server = serverSide(server.since(s.server))
+		s.report.findDiscrepancies()
+	}
+	return s.report, nil
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
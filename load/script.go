@@ -0,0 +1,536 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/dop251/goja"
+	"github.com/prometheus/client_golang/prometheus"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	scriptChecks = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "script_checks_total",
+			Help: "Number of checks run by the load script",
+		},
+		[]string{"check", "result"},
+	)
+	scriptErrors = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "script_errors_total",
+			Help: "Number of load script iterations that threw an error",
+		},
+	)
+)
+
+// scriptMetric is a metric declared by the script. VUs declaring the same
+// name share it.
+type scriptMetric struct {
+	kind      string
+	labels    []string
+	counter   *prometheus.CounterVec
+	gauge     *prometheus.GaugeVec
+	histogram *prometheus.HistogramVec
+}
+
+// scriptRunner holds what the VUs running a script share: the compiled
+// program, the HTTP client, what setup returned, declared metrics and
+// shared data.
+type scriptRunner struct {
+	path       string
+	program    *goja.Program
+	client     *http.Client
+	registerer prometheus.Registerer
+	lifecycle  *goja.Runtime
+	data       []byte
+
+	lock    sync.Mutex
+	metrics map[string]*scriptMetric
+	shared  map[string][]byte
+}
+
+func newScriptRunner(path string, client *http.Client, registerer prometheus.Registerer) (*scriptRunner, error) {
+	source, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	program, err := goja.Compile(path, string(source), false)
+	if err != nil {
+		return nil, err
+	}
+	return &scriptRunner{
+		path:       path,
+		program:    program,
+		client:     client,
+		registerer: registerer,
+		metrics:    map[string]*scriptMetric{},
+		shared:     map[string][]byte{},
+	}, nil
+}
+
+// newRuntime runs the script's top level code in a runtime of its own.
+// Requests count as hook traffic until the VU starts iterating.
+func (s *scriptRunner) newRuntime(id int) (*scriptVU, error) {
+	vm := goja.New()
+	vm.SetFieldNameMapper(goja.TagFieldNameMapper("json", true))
+	vu := &scriptVU{runner: s, vm: vm, id: id, hook: true}
+	if err := vu.install(); err != nil {
+		return nil, err
+	}
+	if _, err := vm.RunProgram(s.program); err != nil {
+		return nil, err
+	}
+	return vu, nil
+}
+
+// setupData gives vm its own copy of what setup returned, frozen so VUs
+// cannot change it.
+func (s *scriptRunner) setupData(vm *goja.Runtime) (goja.Value, error) {
+	if s.data == nil {
+		return goja.Undefined(), nil
+	}
+	parse, _ := goja.AssertFunction(vm.Get("JSON").ToObject(vm).Get("parse"))
+	freeze, _ := goja.AssertFunction(vm.Get("Object").ToObject(vm).Get("freeze"))
+	data, err := parse(goja.Undefined(), vm.ToValue(string(s.data)))
+	if err != nil {
+		return nil, err
+	}
+	var deepFreeze func(v goja.Value) error
+	deepFreeze = func(v goja.Value) error {
+		obj, ok := v.(*goja.Object)
+		if !ok {
+			return nil
+		}
+		for _, key := range obj.Keys() {
+			if err := deepFreeze(obj.Get(key)); err != nil {
+				return err
+			}
+		}
+		_, err := freeze(goja.Undefined(), obj)
+		return err
+	}
+	return data, deepFreeze(data)
+}
+
+// setup calls the script's setup function, if any, in a runtime kept for
+// teardown. What it returns is handed to every VU as data.
+func (s *scriptRunner) setup() error {
+	vu, err := s.newRuntime(0)
+	if err != nil {
+		return err
+	}
+	s.lifecycle = vu.vm
+	setup, ok := goja.AssertFunction(vu.vm.Get("setup"))
+	if !ok {
+		return nil
+	}
+	result, err := setup(goja.Undefined())
+	if err == nil {
+		s.data, err = json.Marshal(result.Export())
+	}
+	if err != nil {
+		return fmt.Errorf("setup: %s", err)
+	}
+	return nil
+}
+
+// teardown calls the script's teardown function, if any, with data.
+func (s *scriptRunner) teardown() error {
+	teardown, ok := goja.AssertFunction(s.lifecycle.Get("teardown"))
+	if !ok {
+		return nil
+	}
+	data, err := s.setupData(s.lifecycle)
+	if err == nil {
+		_, err = teardown(goja.Undefined(), data)
+	}
+	if err != nil {
+		return fmt.Errorf("teardown: %s", err)
+	}
+	return nil
+}
+
+// newVU prepares a VU, calling the script's init function with data, and
+// returns a function calling the script's iteration function once.
+func (s *scriptRunner) newVU(id int) (func(), error) {
+	vu, err := s.newRuntime(id)
+	if err != nil {
+		return nil, err
+	}
+	vm := vu.vm
+	iteration, ok := goja.AssertFunction(vm.Get("iteration"))
+	if !ok {
+		return nil, fmt.Errorf("%s does not define an iteration function", s.path)
+	}
+	data, err := s.setupData(vm)
+	if err != nil {
+		return nil, err
+	}
+	vm.Set("data", data)
+	if init, ok := goja.AssertFunction(vm.Get("init")); ok {
+		if _, err := init(goja.Undefined(), data); err != nil {
+			return nil, fmt.Errorf("init of VU %d: %s", id, err)
+		}
+	}
+	vu.hook = false
+
+	iter := 0
+	return func() {
+		vm.Set("__ITER", iter)
+		iter++
+		if _, err := iteration(goja.Undefined(), data); err != nil {
+			log.Printf("Script iteration failed on VU %d: %s\n", id, err)
+			scriptErrors.Inc()
+		}
+	}, nil
+}
+
+type scriptVU struct {
+	runner *scriptRunner
+	vm     *goja.Runtime
+	id     int
+	hook   bool
+}
+
+func (vu *scriptVU) throw(err error) {
+	panic(vu.vm.NewGoError(err))
+}
+
+func (vu *scriptVU) install() error {
+	vm := vu.vm
+	httpApi := map[string]interface{}{
+		"request": func(method, url string, body goja.Value, params goja.Value) goja.Value {
+			return vu.request(method, url, body, params)
+		},
+		"get": func(url string, params goja.Value) goja.Value {
+			return vu.request("GET", url, goja.Undefined(), params)
+		},
+		"post": func(url string, body goja.Value, params goja.Value) goja.Value {
+			return vu.request("POST", url, body, params)
+		},
+		"put": func(url string, body goja.Value, params goja.Value) goja.Value {
+			return vu.request("PUT", url, body, params)
+		},
+		"del": func(url string, params goja.Value) goja.Value {
+			return vu.request("DELETE", url, goja.Undefined(), params)
+		},
+	}
+	metrics := map[string]interface{}{
+		"counter":   func(name string, opts goja.Value) goja.Value { return vu.metric("counter", name, opts) },
+		"gauge":     func(name string, opts goja.Value) goja.Value { return vu.metric("gauge", name, opts) },
+		"histogram": func(name string, opts goja.Value) goja.Value { return vu.metric("histogram", name, opts) },
+	}
+	shared := map[string]interface{}{
+		"get": vu.sharedGet,
+		"set": vu.sharedSet,
+		"add": vu.sharedAdd,
+	}
+	console := map[string]interface{}{
+		"log": func(call goja.FunctionCall) goja.Value {
+			parts := make([]string, len(call.Arguments))
+			for i, arg := range call.Arguments {
+				parts[i] = arg.String()
+			}
+			log.Printf("[VU %d] %s\n", vu.id, strings.Join(parts, " "))
+			return goja.Undefined()
+		},
+	}
+
+	for name, value := range map[string]interface{}{
+		"__VU":    vu.id,
+		"__ITER":  0,
+		"http":    httpApi,
+		"metrics": metrics,
+		"shared":  shared,
+		"console": console,
+		"check":   vu.check,
+		"sleep":   func(seconds float64) { time.Sleep(time.Duration(seconds * float64(time.Second))) },
+		"open":    vu.open,
+	} {
+		if err := vm.Set(name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// request sends an HTTP request. Relative URLs are resolved against
+// TARGET_URL; object bodies are sent as JSON.
+func (vu *scriptVU) request(method, rawUrl string, body goja.Value, params goja.Value) goja.Value {
+	base, err := url.Parse(targetUrl)
+	if err != nil {
+		vu.throw(err)
+	}
+	ref, err := url.Parse(rawUrl)
+	if err != nil {
+		vu.throw(err)
+	}
+
+	var payload []byte
+	contentType := ""
+	if body != nil && !goja.IsUndefined(body) && !goja.IsNull(body) {
+		if _, ok := body.Export().(string); ok {
+			payload = []byte(body.String())
+		} else {
+			if payload, err = json.Marshal(body.Export()); err != nil {
+				vu.throw(err)
+			}
+			contentType = "application/json"
+		}
+	}
+
+	req, err := http.NewRequest(method, base.ResolveReference(ref).String(), bytes.NewReader(payload))
+	if err != nil {
+		vu.throw(err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if params != nil && !goja.IsUndefined(params) && !goja.IsNull(params) {
+		var p struct {
+			Headers map[string]string `json:"headers"`
+		}
+		if err := vu.vm.ExportTo(params, &p); err != nil {
+			vu.throw(err)
+		}
+		for name, value := range p.Headers {
+			req.Header.Set(name, value)
+		}
+	}
+
+	var received bytes.Buffer
+	start := time.Now()
+	send := sendRequest
+	if vu.hook {
+		send = doRequest
+	}
+	resp, err := send(vu.runner.client, req, &received)
+	result := vu.vm.NewObject()
+	result.Set("duration", float64(time.Since(start))/float64(time.Millisecond))
+	result.Set("body", received.String())
+	result.Set("json", func() goja.Value {
+		var v interface{}
+		if err := json.Unmarshal(received.Bytes(), &v); err != nil {
+			vu.throw(err)
+		}
+		return vu.vm.ToValue(v)
+	})
+	if err != nil {
+		result.Set("error", err.Error())
+	} else {
+		result.Set("error", nil)
+	}
+	if resp != nil {
+		result.Set("status", resp.StatusCode)
+		headers := map[string]interface{}{}
+		for name := range resp.Header {
+			headers[name] = resp.Header.Get(name)
+		}
+		result.Set("headers", headers)
+	} else {
+		result.Set("status", 0)
+		result.Set("headers", map[string]interface{}{})
+	}
+	return result
+}
+
+// check calls every function of checks with value, counts the results in
+// script_checks_total and tells whether all of them passed.
+func (vu *scriptVU) check(value goja.Value, arg goja.Value) bool {
+	checks, ok := arg.(*goja.Object)
+	if !ok {
+		vu.throw(fmt.Errorf("checks must be an object"))
+	}
+	passed := true
+	for _, name := range checks.Keys() {
+		fn, ok := goja.AssertFunction(checks.Get(name))
+		if !ok {
+			vu.throw(fmt.Errorf("check %q is not a function", name))
+		}
+		result, err := fn(goja.Undefined(), value)
+		if err != nil {
+			vu.throw(err)
+		}
+		label := "pass"
+		if !result.ToBoolean() {
+			label = "fail"
+			passed = false
+		}
+		scriptChecks.With(prometheus.Labels{"check": name, "result": label}).Inc()
+	}
+	return passed
+}
+
+func (vu *scriptVU) open(path string) string {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(filepath.Dir(vu.runner.path), path)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		vu.throw(err)
+	}
+	return string(data)
+}
+
+// metric declares a metric, or returns the one already declared with the
+// same name, as an object with add, set or observe.
+func (vu *scriptVU) metric(kind, name string, opts goja.Value) goja.Value {
+	var o struct {
+		Help    string    `json:"help"`
+		Labels  []string  `json:"labels"`
+		Buckets []float64 `json:"buckets"`
+	}
+	if opts != nil && !goja.IsUndefined(opts) && !goja.IsNull(opts) {
+		if err := vu.vm.ExportTo(opts, &o); err != nil {
+			vu.throw(err)
+		}
+	}
+	if o.Help == "" {
+		o.Help = "Declared by the load script"
+	}
+
+	m, err := vu.runner.declare(kind, name, o.Help, o.Labels, o.Buckets)
+	if err != nil {
+		vu.throw(err)
+	}
+	labels := func(v goja.Value) prometheus.Labels {
+		l := prometheus.Labels{}
+		if v != nil && !goja.IsUndefined(v) && !goja.IsNull(v) {
+			values, ok := v.Export().(map[string]interface{})
+			if !ok {
+				vu.throw(fmt.Errorf("labels must be an object"))
+			}
+			for key, value := range values {
+				l[key] = fmt.Sprint(value)
+			}
+		}
+		return l
+	}
+	with := func(v goja.Value, f func(prometheus.Labels) error) {
+		if err := f(labels(v)); err != nil {
+			vu.throw(err)
+		}
+	}
+
+	obj := vu.vm.NewObject()
+	switch m.kind {
+	case "counter":
+		obj.Set("add", func(value float64, l goja.Value) {
+			with(l, func(l prometheus.Labels) error {
+				c, err := m.counter.GetMetricWith(l)
+				if err == nil {
+					c.Add(value)
+				}
+				return err
+			})
+		})
+	case "gauge":
+		obj.Set("set", func(value float64, l goja.Value) {
+			with(l, func(l prometheus.Labels) error {
+				g, err := m.gauge.GetMetricWith(l)
+				if err == nil {
+					g.Set(value)
+				}
+				return err
+			})
+		})
+		obj.Set("add", func(value float64, l goja.Value) {
+			with(l, func(l prometheus.Labels) error {
+				g, err := m.gauge.GetMetricWith(l)
+				if err == nil {
+					g.Add(value)
+				}
+				return err
+			})
+		})
+	case "histogram":
+		obj.Set("observe", func(value float64, l goja.Value) {
+			with(l, func(l prometheus.Labels) error {
+				h, err := m.histogram.GetMetricWith(l)
+				if err == nil {
+					h.Observe(value)
+				}
+				return err
+			})
+		})
+	}
+	return obj
+}
+
+func (s *scriptRunner) declare(kind, name, help string, labels []string, buckets []float64) (*scriptMetric, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if m, ok := s.metrics[name]; ok {
+		if m.kind != kind || fmt.Sprint(m.labels) != fmt.Sprint(labels) {
+			return nil, fmt.Errorf("metric %s is already declared as a %s with labels %v", name, m.kind, m.labels)
+		}
+		return m, nil
+	}
+
+	m := &scriptMetric{kind: kind, labels: labels}
+	var collector prometheus.Collector
+	switch kind {
+	case "counter":
+		m.counter = prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: help}, labels)
+		collector = m.counter
+	case "gauge":
+		m.gauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: help}, labels)
+		collector = m.gauge
+	case "histogram":
+		m.histogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: name, Help: help, Buckets: buckets}, labels)
+		collector = m.histogram
+	}
+	if err := s.registerer.Register(collector); err != nil {
+		return nil, fmt.Errorf("metric %s: %s", name, err)
+	}
+	s.metrics[name] = m
+	return m, nil
+}
+
+// Shared data is kept as JSON so no VU ever holds another VU's objects.
+
+func (vu *scriptVU) sharedGet(key string) goja.Value {
+	vu.runner.lock.Lock()
+	data, ok := vu.runner.shared[key]
+	vu.runner.lock.Unlock()
+	if !ok {
+		return goja.Undefined()
+	}
+	var v interface{}
+	json.Unmarshal(data, &v)
+	return vu.vm.ToValue(v)
+}
+
+func (vu *scriptVU) sharedSet(key string, value goja.Value) {
+	data, err := json.Marshal(value.Export())
+	if err != nil {
+		vu.throw(err)
+	}
+	vu.runner.lock.Lock()
+	vu.runner.shared[key] = data
+	vu.runner.lock.Unlock()
+}
+
+// sharedAdd adds delta to the number stored under key and returns the sum.
+func (vu *scriptVU) sharedAdd(key string, delta float64) float64 {
+	vu.runner.lock.Lock()
+	defer vu.runner.lock.Unlock()
+	var current float64
+	if data, ok := vu.runner.shared[key]; ok {
+		if err := json.Unmarshal(data, &current); err != nil {
+			vu.throw(fmt.Errorf("shared %s is not a number", key))
+		}
+	}
+	current += delta
+	vu.runner.shared[key], _ = json.Marshal(current)
+	return current
+}
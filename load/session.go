@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"log"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	sessionsStarted = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "sessions_total",
+			Help: "Number of user sessions started",
+		},
+	)
+	activeSessions = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "active_sessions",
+			Help: "Number of user sessions in progress",
+		},
+	)
+)
+
+// sampler draws a value, never below zero.
+type sampler func() float64
+
+// parseDistribution reads a number, constant:v, uniform:min,max,
+// exponential:mean, normal:mean,stddev or lognormal:mean,sigma.
+func parseDistribution(spec string) (sampler, error) {
+	if v, err := strconv.ParseFloat(spec, 64); err == nil && v >= 0 {
+		return func() float64 { return v }, nil
+	}
+	parts := strings.SplitN(spec, ":", 2)
+	var params []float64
+	if len(parts) == 2 {
+		for _, p := range strings.Split(parts[1], ",") {
+			v, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+			if err != nil || v < 0 {
+				return nil, fmt.Errorf("%s: %q is not a non-negative number", spec, p)
+			}
+			params = append(params, v)
+		}
+	}
+	expect := func(n int) error {
+		if len(params) != n {
+			return fmt.Errorf("%s: %s takes %d parameters", spec, parts[0], n)
+		}
+		return nil
+	}
+
+	switch parts[0] {
+	case "constant":
+		if err := expect(1); err != nil {
+			return nil, err
+		}
+		return func() float64 { return params[0] }, nil
+	case "uniform":
+		if err := expect(2); err != nil {
+			return nil, err
+		}
+		return func() float64 { return params[0] + rand.Float64()*(params[1]-params[0]) }, nil
+	case "exponential":
+		if err := expect(1); err != nil {
+			return nil, err
+		}
+		return func() float64 { return rand.ExpFloat64() * params[0] }, nil
+	case "normal":
+		if err := expect(2); err != nil {
+			return nil, err
+		}
+		return func() float64 { return math.Max(0, params[0]+rand.NormFloat64()*params[1]) }, nil
+	case "lognormal":
+		if err := expect(2); err != nil {
+			return nil, err
+		}
+		if params[0] == 0 {
+			return nil, fmt.Errorf("%s: the mean must be positive", spec)
+		}
+		mu := math.Log(params[0]) - params[1]*params[1]/2
+		return func() float64 { return math.Exp(mu + params[1]*rand.NormFloat64()) }, nil
+	}
+	return nil, fmt.Errorf("unknown distribution %q", spec)
+}
+
+// sessionRunner models VUs as users: a session runs a number of iterations
+// drawn from length on a VU of its own, with think seconds between them.
+type sessionRunner struct {
+	users     int
+	newVU     func(id int) (func(), error)
+	length    sampler
+	thinkTime sampler
+	deadline  time.Time
+}
+
+// think sleeps for a think time, at least min, but not past the deadline.
+func (r sessionRunner) think(min time.Duration) {
+	think := time.Duration(r.thinkTime() * float64(time.Second))
+	if think < min {
+		think = min
+	}
+	if left := time.Until(r.deadline); think > left {
+		think = left
+	}
+	time.Sleep(think)
+}
+
+// session runs the session of user id on a new VU, so nothing the previous
+// user left behind carries over, and returns how many iterations it ran.
+func (r sessionRunner) session(id int) int {
+	vu, err := r.newVU(id)
+	if err != nil {
+		log.Printf("Failed to start a session on VU %d: %s\n", id, err)
+		return 0
+	}
+	sessionsStarted.Inc()
+	activeSessions.Inc()
+	defer activeSessions.Dec()
+
+	n := int(math.Round(r.length()))
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			r.think(0)
+		}
+		if !time.Now().Before(r.deadline) {
+			return i
+		}
+		vu()
+	}
+	return n
+}
+
+// run keeps every user busy with one session after the other until the
+// deadline, or starts sessions at rate following the arrival process,
+// dropping those finding every user busy.
+func (r sessionRunner) run(rate float64, process arrivalProcess) {
+	log.Printf("Running sessions of up to %d users until %s\n", r.users, r.deadline.Format(time.RFC3339))
+	if rate <= 0 {
+		var wg sync.WaitGroup
+		for id := 1; id <= r.users; id++ {
+			wg.Add(1)
+			go func(id int) {
+				defer wg.Done()
+				for time.Now().Before(r.deadline) {
+					// Sessions without iterations would otherwise follow
+					// each other without pause
+					if r.session(id) == 0 {
+						r.think(time.Duration(minTimeBetweenReqsMs) * time.Millisecond)
+					}
+				}
+			}(id)
+		}
+		wg.Wait()
+		return
+	}
+
+	free := make(chan int, r.users)
+	for id := 1; id <= r.users; id++ {
+		free <- id
+	}
+	// the dispatcher never lets more sessions run than there are users, so
+	// one is always free
+	d := newDispatcher(r.users)
+	curve := constantRate(rate, time.Until(r.deadline))
+	t := time.Duration(0)
+	for {
+		gap, batch := process()
+		var ok bool
+		if t, ok = curve.advance(t, gap); !ok {
+			break
+		}
+		for i := 0; i < batch; i++ {
+			d.at(t, func() {
+				id := <-free
+				r.session(id)
+				free <- id
+			})
+		}
+	}
+	d.wait()
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestParseDistribution(t *testing.T) {
+	tests := []struct {
+		spec     string
+		wantMean float64
+		wantErr  bool
+	}{
+		{spec: "3", wantMean: 3},
+		{spec: "0", wantMean: 0},
+		{spec: "constant:2.5", wantMean: 2.5},
+		{spec: "uniform:1,3", wantMean: 2},
+		{spec: "exponential:4", wantMean: 4},
+		{spec: "normal:5,1", wantMean: 5},
+		{spec: "lognormal:3,0.8", wantMean: 3},
+		{spec: "-1", wantErr: true},
+		{spec: "constant", wantErr: true},
+		{spec: "constant:1,2", wantErr: true},
+		{spec: "uniform:1", wantErr: true},
+		{spec: "exponential:x", wantErr: true},
+		{spec: "normal:5,-1", wantErr: true},
+		{spec: "lognormal:0,1", wantErr: true},
+		{spec: "gamma:1,2", wantErr: true},
+		{spec: "", wantErr: true},
+	}
+	rand.Seed(1)
+	for _, tt := range tests {
+		sample, err := parseDistribution(tt.spec)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: error %v, want error: %t", tt.spec, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		const draws = 20000
+		var sum float64
+		for i := 0; i < draws; i++ {
+			v := sample()
+			if v < 0 {
+				t.Fatalf("%q: drew %g", tt.spec, v)
+			}
+			sum += v
+		}
+		if mean := sum / draws; math.Abs(mean-tt.wantMean) > 0.05*tt.wantMean+1e-9 {
+			t.Errorf("%q: mean %f, want %f", tt.spec, mean, tt.wantMean)
+		}
+	}
+}
+
+func TestSession(t *testing.T) {
+	tests := []struct {
+		length         float64
+		wantIterations int
+	}{
+		{0, 0},
+		{0.4, 0},
+		{1, 1},
+		{2.6, 3},
+	}
+	for _, tt := range tests {
+		vus := 0
+		iterations := 0
+		r := sessionRunner{
+			users: 1,
+			newVU: func(id int) (func(), error) {
+				vus++
+				return func() { iterations++ }, nil
+			},
+			length:    func() float64 { return tt.length },
+			thinkTime: func() float64 { return 0 },
+			deadline:  time.Now().Add(time.Minute),
+		}
+		ran := r.session(1)
+		if ran != tt.wantIterations || iterations != tt.wantIterations {
+			t.Errorf("length %g: ran %d iterations, reported %d, want %d", tt.length, iterations, ran, tt.wantIterations)
+		}
+		if r.session(1); vus != 2 {
+			t.Errorf("length %g: two sessions used %d VUs, want a new one each", tt.length, vus)
+		}
+	}
+
+	r := sessionRunner{
+		newVU:    func(id int) (func(), error) { return nil, fmt.Errorf("init failed") },
+		length:   func() float64 { return 1 },
+		deadline: time.Now().Add(time.Minute),
+	}
+	if ran := r.session(1); ran != 0 {
+		t.Errorf("a session whose VU failed to start ran %d iterations", ran)
+	}
+
+	r = sessionRunner{
+		newVU:    func(id int) (func(), error) { return func() { t.Error("iteration after the deadline") }, nil },
+		length:   func() float64 { return 5 },
+		deadline: time.Now(),
+	}
+	if ran := r.session(1); ran != 0 {
+		t.Errorf("a session past the deadline ran %d iterations", ran)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"math"
+	"strconv"
+)
+
+// snapshot is a copy of the load tester's own counters at one point in time.
+// Subtracting two snapshots gives what happened in between.
+type snapshot struct {
+	Codes           map[string]float64
+	HookCodes       map[string]float64
+	TransportErrors float64
+	BucketBounds    []float64
+	BucketCounts    []float64
+	Count           float64
+	Sum             float64
+}
+
+func takeSnapshot(gatherer prometheus.Gatherer) (snapshot, error) {
+	s := snapshot{Codes: map[string]float64{}, HookCodes: map[string]float64{}}
+	families, err := gatherer.Gather()
+	if err != nil {
+		return s, err
+	}
+
+	for _, family := range families {
+		switch family.GetName() {
+		case "http_requests_total":
+			for _, m := range family.GetMetric() {
+				for _, label := range m.GetLabel() {
+					if label.GetName() == "code" {
+						s.Codes[label.GetValue()] += m.GetCounter().GetValue()
+					}
+				}
+			}
+		case "hook_requests_total":
+			for _, m := range family.GetMetric() {
+				for _, label := range m.GetLabel() {
+					if label.GetName() == "code" {
+						s.HookCodes[label.GetValue()] += m.GetCounter().GetValue()
+					}
+				}
+			}
+		case "http_errors_total":
+			for _, m := range family.GetMetric() {
+				s.TransportErrors += m.GetCounter().GetValue()
+			}
+		case "http_request_duration_hist_microseconds":
+			for _, m := range family.GetMetric() {
+				h := m.GetHistogram()
+				s.Count = float64(h.GetSampleCount())
+				s.Sum = h.GetSampleSum()
+				for _, b := range h.GetBucket() {
+					s.BucketBounds = append(s.BucketBounds, b.GetUpperBound())
+					s.BucketCounts = append(s.BucketCounts, float64(b.GetCumulativeCount()))
+				}
+			}
+		}
+	}
+	return s, nil
+}
+
+func (s snapshot) since(prev snapshot) snapshot {
+	d := snapshot{
+		Codes:           map[string]float64{},
+		HookCodes:       map[string]float64{},
+		TransportErrors: s.TransportErrors - prev.TransportErrors,
+		BucketBounds:    s.BucketBounds,
+		Count:           s.Count - prev.Count,
+		Sum:             s.Sum - prev.Sum,
+	}
+	for code, n := range s.Codes {
+		d.Codes[code] = n - prev.Codes[code]
+	}
+	for code, n := range s.HookCodes {
+		if n -= prev.HookCodes[code]; n > 0 {
+			d.HookCodes[code] = n
+		}
+	}
+	for i, n := range s.BucketCounts {
+		if i < len(prev.BucketCounts) {
+			n -= prev.BucketCounts[i]
+		}
+		d.BucketCounts = append(d.BucketCounts, n)
+	}
+	return d
+}
+
+func (s snapshot) responses() float64 {
+	var total float64
+	for _, n := range s.Codes {
+		total += n
+	}
+	return total
+}
+
+// failures counts transport errors and responses with a 5xx status.
+func (s snapshot) failures() float64 {
+	total := s.TransportErrors
+	for code, n := range s.Codes {
+		if c, err := strconv.Atoi(code); err == nil && c >= 500 {
+			total += n
+		}
+	}
+	return total
+}
+
+func (s snapshot) errorRate() float64 {
+	attempts := s.responses() + s.TransportErrors
+	if attempts == 0 {
+		return 0
+	}
+	return s.failures() / attempts
+}
+
+// quantile estimates the q-quantile of request durations in microseconds by
+// linear interpolation within the histogram bucket that contains it.
+func (s snapshot) quantile(q float64) float64 {
+	if s.Count == 0 || len(s.BucketCounts) == 0 {
+		return math.NaN()
+	}
+	rank := q * s.Count
+	lowerBound, lowerCount := 0.0, 0.0
+	for i, count := range s.BucketCounts {
+		if count >= rank {
+			if count == lowerCount {
+				return s.BucketBounds[i]
+			}
+			return lowerBound + (s.BucketBounds[i]-lowerBound)*(rank-lowerCount)/(count-lowerCount)
+		}
+		lowerBound, lowerCount = s.BucketBounds[i], count
+	}
+	return s.BucketBounds[len(s.BucketBounds)-1]
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	configReloadSuccess = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "failserver_config_reload_success",
+			Help: "Whether the last configuration reload attempt succeeded",
+		},
+	)
+	configReloadTimestamp = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "failserver_config_last_reload_success_timestamp_seconds",
+			Help: "Timestamp of the last successful configuration reload",
+		},
+	)
+)
+
+func parseConfig(data []byte) (Config, error) {
+	var cfg Config
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&cfg); err != nil {
+		return cfg, err
+	}
+	return cfg, cfg.validate()
+}
+
+// configWatcher reloads the fault configuration from a file whenever its
+// content changes or the process receives SIGHUP. A file that fails to parse
+// or validate leaves the active configuration untouched.
+type configWatcher struct {
+	path     string
+	interval time.Duration
+
+	lock    sync.Mutex
+	lastSum [sha256.Size]byte
+}
+
+// sum returns the checksum of the file content that was last loaded.
+func (cw *configWatcher) sum() [sha256.Size]byte {
+	cw.lock.Lock()
+	defer cw.lock.Unlock()
+	return cw.lastSum
+}
+
+func (cw *configWatcher) setSum(sum [sha256.Size]byte) {
+	cw.lock.Lock()
+	defer cw.lock.Unlock()
+	cw.lastSum = sum
+}
+
+func (cw *configWatcher) reload(force bool) error {
+	data, err := ioutil.ReadFile(cw.path)
+	if err != nil {
+		configReloadSuccess.Set(0)
+		return err
+	}
+	sum := sha256.Sum256(data)
+	if !force && sum == cw.sum() {
+		return nil
+	}
+	cw.setSum(sum)
+
+	cfg, err := parseConfig(data)
+	if err == nil {
+		err = setConfig(cfg, "file:"+cw.path)
+	}
+	if err != nil {
+		configReloadSuccess.Set(0)
+		return fmt.Errorf("%s: %s", cw.path, err)
+	}
+	configReloadSuccess.Set(1)
+	configReloadTimestamp.SetToCurrentTime()
+	return nil
+}
+
+func (cw *configWatcher) watch() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ticker := time.NewTicker(cw.interval)
+	defer ticker.Stop()
+
+	for {
+		force := false
+		select {
+		case <-ticker.C:
+		case <-hup:
+			log.Printf("Received SIGHUP, reloading %s\n", cw.path)
+			force = true
+		}
+		if err := cw.reload(force); err != nil {
+			log.Printf("Keeping previous config, reload failed: %s\n", err)
+		}
+	}
+}
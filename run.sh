@@ -14,6 +14,7 @@ print_help() {
 
 Commands:
 load  = run the load test and exit
+history [flags] = show the trend of past load test runs
 help  = print this help
 build = (re)build local Docker images
 
@@ -25,6 +26,11 @@ EOF
 run_load_test() {
     docker-compose -f docker-compose.load.yml up --abort-on-container-exit
     log_json ./results/results.json
+    log_json ./results/report.json
+}
+
+show_history() {
+    docker-compose -f docker-compose.load.yml run --rm --no-deps load app history "$@"
 }
 
 run_service() {
@@ -43,6 +49,7 @@ main() {
     case "$command" in
         help) print_help "$@" ;;
         load) run_load_test "$@" ;;
+        history) show_history "$@" ;;
         build) build_images "$@" ;;
         *) run_service "$@" ;;
     esac
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const envPrefix = "FAILSERVER_"
+
+// Settings are the process-level options failserver starts with. Unlike the
+// fault Config they cannot change while the server is running.
+type Settings struct {
+	ListenAddr     string   `json:"listen_addr"`
+	MaxLatency     Duration `json:"max_latency"`
+	ConfigFile     string   `json:"config_file"`
+	AuditLogFile   string   `json:"audit_log_file"`
+	ReloadInterval Duration `json:"reload_interval"`
+	NodeID         string   `json:"node_id"`
+	ClusterAddr    string   `json:"cluster_addr"`
+	ClusterPeers   []string `json:"cluster_peers"`
+	ClusterSecret  string   `json:"-"`
+	StateFile      string   `json:"state_file"`
+	Zone           string   `json:"zone"`
+	Region         string   `json:"region"`
+	ClockOffset    Duration `json:"clock_offset"`
+	JWTSecret      string   `json:"-"`
+	MaxRequestBody int64    `json:"max_request_body"`
+
+	LBBackends       []string `json:"lb_backends"`
+	LBAlgorithm      string   `json:"lb_algorithm"`
+	LBHashHeader     string   `json:"lb_hash_header"`
+	LBHealthPath     string   `json:"lb_health_path"`
+	LBHealthInterval Duration `json:"lb_health_interval"`
+	LBEjectAfter     int      `json:"lb_eject_after"`
+	LBEjectionTime   Duration `json:"lb_ejection_time"`
+}
+
+type settingDef struct {
+	name  string
+	usage string
+	set   func(s *Settings, value string) error
+}
+
+func stringSetting(field func(s *Settings) *string) func(*Settings, string) error {
+	return func(s *Settings, value string) error {
+		*field(s) = value
+		return nil
+	}
+}
+
+func durationSetting(field func(s *Settings) *Duration) func(*Settings, string) error {
+	return func(s *Settings, value string) error {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a duration such as \"250ms\"", value)
+		}
+		*field(s) = Duration(d)
+		return nil
+	}
+}
+
+func intSetting(field func(s *Settings) *int) func(*Settings, string) error {
+	return func(s *Settings, value string) error {
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%q is not an integer", value)
+		}
+		*field(s) = i
+		return nil
+	}
+}
+
+func int64Setting(field func(s *Settings) *int64) func(*Settings, string) error {
+	return func(s *Settings, value string) error {
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not an integer", value)
+		}
+		*field(s) = i
+		return nil
+	}
+}
+
+func listSetting(field func(s *Settings) *[]string) func(*Settings, string) error {
+	return func(s *Settings, value string) error {
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		*field(s) = items
+		return nil
+	}
+}
+
+var settingDefs = []settingDef{
+	{"listen_addr", "address to serve HTTP on", stringSetting(func(s *Settings) *string { return &s.ListenAddr })},
+	{"max_latency", "upper bound of the random latency added to every request, e.g. 250ms", durationSetting(func(s *Settings) *Duration { return &s.MaxLatency })},
+	{"config_file", "JSON file with fault rules, reloaded when it changes", stringSetting(func(s *Settings) *string { return &s.ConfigFile })},
+	{"audit_log_file", "file that config changes are appended to", stringSetting(func(s *Settings) *string { return &s.AuditLogFile })},
+	{"reload_interval", "how often config_file is checked for changes", durationSetting(func(s *Settings) *Duration { return &s.ReloadInterval })},
+	{"node_id", "name of this instance within a cluster", stringSetting(func(s *Settings) *string { return &s.NodeID })},
+	{"cluster_addr", "TCP address to exchange state with other replicas on, empty disables cluster mode", stringSetting(func(s *Settings) *string { return &s.ClusterAddr })},
+	{"cluster_peers", "comma-separated cluster_addr of the other replicas", listSetting(func(s *Settings) *[]string { return &s.ClusterPeers })},
+	{"cluster_secret", "key replicas sign cluster messages with, unsigned ones are accepted when empty", stringSetting(func(s *Settings) *string { return &s.ClusterSecret })},
+	{"zone", "availability zone this instance runs in", stringSetting(func(s *Settings) *string { return &s.Zone })},
+	{"region", "region this instance runs in", stringSetting(func(s *Settings) *string { return &s.Region })},
+	{"clock_offset", "offset added to every timestamp this instance generates, e.g. -90s", durationSetting(func(s *Settings) *Duration { return &s.ClockOffset })},
+	{"jwt_secret", "HMAC key for the tokens issued on /token", stringSetting(func(s *Settings) *string { return &s.JWTSecret })},
+	{"max_request_body", "largest request body accepted, in bytes after decompression", int64Setting(func(s *Settings) *int64 { return &s.MaxRequestBody })},
+	{"lb_backends", "comma-separated backend URLs, turns failserver into a load balancer in front of them", listSetting(func(s *Settings) *[]string { return &s.LBBackends })},
+	{"lb_algorithm", "round_robin, least_conn or consistent_hash", stringSetting(func(s *Settings) *string { return &s.LBAlgorithm })},
+	{"lb_hash_header", "request header consistent_hash keys on, the client IP when empty", stringSetting(func(s *Settings) *string { return &s.LBHashHeader })},
+	{"lb_health_path", "path requested on each backend by health checks", stringSetting(func(s *Settings) *string { return &s.LBHealthPath })},
+	{"lb_health_interval", "time between backend health checks", durationSetting(func(s *Settings) *Duration { return &s.LBHealthInterval })},
+	{"lb_eject_after", "consecutive failed requests after which a backend is ejected", intSetting(func(s *Settings) *int { return &s.LBEjectAfter })},
+	{"lb_ejection_time", "how long an ejected backend receives no traffic", durationSetting(func(s *Settings) *Duration { return &s.LBEjectionTime })},
+	{"state_file", "file the runtime config and counters are persisted to and restored from", stringSetting(func(s *Settings) *string { return &s.StateFile })},
+}
+
+func defaultSettings() Settings {
+	hostname, _ := os.Hostname()
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	return Settings{
+		ListenAddr:     ":8080",
+		ReloadInterval: Duration(5 * time.Second),
+		NodeID:         hostname,
+		JWTSecret:      hex.EncodeToString(secret),
+		MaxRequestBody: 10 << 20,
+
+		LBAlgorithm:      lbRoundRobin,
+		LBHealthPath:     "/version",
+		LBHealthInterval: Duration(2 * time.Second),
+		LBEjectAfter:     5,
+		LBEjectionTime:   Duration(30 * time.Second),
+	}
+}
+
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(name)
+}
+
+func flagName(name string) string {
+	return strings.Replace(name, "_", "-", -1)
+}
+
+func findSetting(name string) *settingDef {
+	for i := range settingDefs {
+		if settingDefs[i].name == name {
+			return &settingDefs[i]
+		}
+	}
+	return nil
+}
+
+// settingsLoader applies values from each source in increasing order of
+// precedence and remembers every problem it finds instead of stopping at the
+// first one.
+type settingsLoader struct {
+	settings Settings
+	sources  map[string]string
+	problems []string
+}
+
+func (l *settingsLoader) apply(def *settingDef, value, source string) {
+	if err := def.set(&l.settings, value); err != nil {
+		l.problems = append(l.problems, fmt.Sprintf("%s: %s: %s", source, def.name, err))
+		return
+	}
+	l.sources[def.name] = source
+}
+
+func (l *settingsLoader) loadFile(path string) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		l.problems = append(l.problems, err.Error())
+		return
+	}
+	var values map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&values); err != nil {
+		l.problems = append(l.problems, fmt.Sprintf("%s: %s", path, err))
+		return
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		def := findSetting(key)
+		if def == nil {
+			l.problems = append(l.problems, fmt.Sprintf("file:%s: unknown setting %q", path, key))
+			continue
+		}
+		value, ok := settingString(values[key])
+		if !ok {
+			l.problems = append(l.problems, fmt.Sprintf("file:%s: %s: value must be a string, number, boolean or list of strings", path, key))
+			continue
+		}
+		l.apply(def, value, "file:"+path)
+	}
+}
+
+// settingString converts a JSON value to the form the setting would have in
+// the environment, lists being comma-separated.
+func settingString(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	case bool:
+		return strconv.FormatBool(v), true
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return "", false
+			}
+			items = append(items, s)
+		}
+		return strings.Join(items, ","), true
+	}
+	return "", false
+}
+
+func (l *settingsLoader) loadEnv(environ []string) {
+	env := map[string]string{}
+	for _, kv := range environ {
+		if i := strings.Index(kv, "="); i >= 0 {
+			env[kv[:i]] = kv[i+1:]
+		}
+	}
+
+	// MAX_LATENCY_MS predates the FAILSERVER_ settings and takes plain
+	// milliseconds, but a unit is accepted too.
+	if value, ok := env["MAX_LATENCY_MS"]; ok {
+		if _, err := strconv.Atoi(value); err == nil {
+			value += "ms"
+		}
+		l.apply(findSetting("max_latency"), value, "env:MAX_LATENCY_MS")
+	}
+
+	for i := range settingDefs {
+		def := &settingDefs[i]
+		if value, ok := env[envName(def.name)]; ok {
+			l.apply(def, value, "env:"+envName(def.name))
+		}
+	}
+
+	var unknown []string
+	for key := range env {
+		if strings.HasPrefix(key, envPrefix) && key != envPrefix+"SETTINGS_FILE" && findSetting(strings.ToLower(strings.TrimPrefix(key, envPrefix))) == nil {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+	for _, key := range unknown {
+		l.problems = append(l.problems, fmt.Sprintf("env: unknown setting %s", key))
+	}
+}
+
+func (l *settingsLoader) validate() {
+	s := l.settings
+	if s.ListenAddr == "" {
+		l.problems = append(l.problems, "listen_addr must not be empty")
+	}
+	if s.MaxLatency < 0 {
+		l.problems = append(l.problems, "max_latency must not be negative")
+	}
+	if s.ReloadInterval <= 0 {
+		l.problems = append(l.problems, "reload_interval must be positive")
+	}
+	if s.NodeID == "" {
+		l.problems = append(l.problems, "node_id must not be empty")
+	}
+	if len(s.ClusterPeers) > 0 && s.ClusterAddr == "" {
+		l.problems = append(l.problems, "cluster_peers requires cluster_addr")
+	}
+	switch s.LBAlgorithm {
+	case lbRoundRobin, lbLeastConn, lbConsistentHash:
+	default:
+		l.problems = append(l.problems, fmt.Sprintf("lb_algorithm %q is not one of %s, %s, %s", s.LBAlgorithm, lbRoundRobin, lbLeastConn, lbConsistentHash))
+	}
+	for _, backend := range s.LBBackends {
+		if u, err := url.Parse(backend); err != nil || u.Scheme == "" || u.Host == "" {
+			l.problems = append(l.problems, fmt.Sprintf("lb_backends: %q is not an absolute URL", backend))
+		}
+	}
+	if s.LBHealthInterval <= 0 {
+		l.problems = append(l.problems, "lb_health_interval must be positive")
+	}
+	if s.LBEjectionTime <= 0 {
+		l.problems = append(l.problems, "lb_ejection_time must be positive")
+	}
+	if s.MaxRequestBody <= 0 {
+		l.problems = append(l.problems, "max_request_body must be positive")
+	}
+	if s.LBEjectAfter <= 0 {
+		l.problems = append(l.problems, "lb_eject_after must be positive")
+	}
+}
+
+// loadSettings builds the effective settings from defaults, an optional
+// settings file, FAILSERVER_* environment variables and command line flags,
+// each overriding the previous one. It returns the settings together with the
+// source each value came from.
+func loadSettings(args []string, environ []string) (Settings, map[string]string, error) {
+	l := &settingsLoader{settings: defaultSettings(), sources: map[string]string{}}
+	for _, def := range settingDefs {
+		l.sources[def.name] = "default"
+	}
+
+	fs := flag.NewFlagSet("failserver", flag.ContinueOnError)
+	settingsFile := fs.String("settings", "", "JSON file with settings, also read from "+envPrefix+"SETTINGS_FILE")
+	for _, def := range settingDefs {
+		fs.String(flagName(def.name), "", fmt.Sprintf("%s (env %s)", def.usage, envName(def.name)))
+	}
+	if err := fs.Parse(args); err == flag.ErrHelp {
+		return l.settings, l.sources, err
+	} else if err != nil {
+		l.problems = append(l.problems, err.Error())
+	}
+	if fs.NArg() > 0 {
+		l.problems = append(l.problems, fmt.Sprintf("unexpected arguments: %s", strings.Join(fs.Args(), " ")))
+	}
+
+	path := *settingsFile
+	if path == "" {
+		for _, kv := range environ {
+			if strings.HasPrefix(kv, envPrefix+"SETTINGS_FILE=") {
+				path = strings.TrimPrefix(kv, envPrefix+"SETTINGS_FILE=")
+			}
+		}
+	}
+	if path != "" {
+		l.loadFile(path)
+	}
+
+	l.loadEnv(environ)
+
+	fs.Visit(func(f *flag.Flag) {
+		if def := findSetting(strings.Replace(f.Name, "-", "_", -1)); def != nil {
+			l.apply(def, f.Value.String(), "flag:-"+f.Name)
+		}
+	})
+
+	l.validate()
+	if len(l.problems) > 0 {
+		return l.settings, l.sources, errors.New("invalid settings:\n  " + strings.Join(l.problems, "\n  "))
+	}
+	return l.settings, l.sources, nil
+}
+
+func effectiveConfigHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, struct {
+		Settings Settings          `json:"settings"`
+		Sources  map[string]string `json:"sources"`
+		Faults   Config            `json:"faults"`
+	}{settings, settingSources, currentConfig()})
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeSettingsFile(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "settings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "settings.json")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadSettingsPrecedence(t *testing.T) {
+	path := writeSettingsFile(t, `{"listen_addr": ":1", "zone": "file", "region": "file", "lb_eject_after": 7}`)
+
+	tests := []struct {
+		name        string
+		args        []string
+		environ     []string
+		wantZone    string
+		wantRegion  string
+		wantListen  string
+		wantSources map[string]string
+	}{
+		{
+			name:       "defaults",
+			wantListen: ":8080",
+			wantSources: map[string]string{
+				"listen_addr": "default",
+				"zone":        "default",
+			},
+		},
+		{
+			name:       "file over defaults",
+			args:       []string{"-settings", path},
+			wantZone:   "file",
+			wantRegion: "file",
+			wantListen: ":1",
+			wantSources: map[string]string{
+				"listen_addr":     "file:" + path,
+				"zone":            "file:" + path,
+				"lb_eject_after":  "file:" + path,
+				"reload_interval": "default",
+			},
+		},
+		{
+			name:       "env over file",
+			environ:    []string{"FAILSERVER_SETTINGS_FILE=" + path, "FAILSERVER_ZONE=env"},
+			wantZone:   "env",
+			wantRegion: "file",
+			wantListen: ":1",
+			wantSources: map[string]string{
+				"zone":   "env:FAILSERVER_ZONE",
+				"region": "file:" + path,
+			},
+		},
+		{
+			name:       "flags over env",
+			args:       []string{"-settings", path, "-zone", "flag", "-listen-addr", ":2"},
+			environ:    []string{"FAILSERVER_ZONE=env", "FAILSERVER_REGION=env"},
+			wantZone:   "flag",
+			wantRegion: "env",
+			wantListen: ":2",
+			wantSources: map[string]string{
+				"zone":        "flag:-zone",
+				"region":      "env:FAILSERVER_REGION",
+				"listen_addr": "flag:-listen-addr",
+			},
+		},
+	}
+	for _, tt := range tests {
+		s, sources, err := loadSettings(tt.args, tt.environ)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if s.Zone != tt.wantZone || s.Region != tt.wantRegion || s.ListenAddr != tt.wantListen {
+			t.Errorf("%s: zone %q, region %q, listen_addr %q, want %q, %q, %q",
+				tt.name, s.Zone, s.Region, s.ListenAddr, tt.wantZone, tt.wantRegion, tt.wantListen)
+		}
+		for name, want := range tt.wantSources {
+			if sources[name] != want {
+				t.Errorf("%s: source of %s is %q, want %q", tt.name, name, sources[name], want)
+			}
+		}
+	}
+}
+
+func TestLoadSettingsFileValues(t *testing.T) {
+	path := writeSettingsFile(t, `{
+	  "max_request_body": 1048576,
+	  "lb_eject_after": 5,
+	  "lb_ejection_time": "1m",
+	  "cluster_addr": ":7946",
+	  "cluster_peers": ["a:7946", "b:7946"]
+	}`)
+	s, _, err := loadSettings([]string{"-settings", path}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.MaxRequestBody != 1048576 || s.LBEjectAfter != 5 || s.LBEjectionTime != Duration(time.Minute) {
+		t.Errorf("got max_request_body %d, lb_eject_after %d, lb_ejection_time %s",
+			s.MaxRequestBody, s.LBEjectAfter, time.Duration(s.LBEjectionTime))
+	}
+	if want := []string{"a:7946", "b:7946"}; !reflect.DeepEqual(s.ClusterPeers, want) {
+		t.Errorf("got cluster_peers %q, want %q", s.ClusterPeers, want)
+	}
+
+	tests := []struct {
+		content string
+		problem string
+	}{
+		{`{"zone": {"name": "a"}}`, "zone: value must be"},
+		{`{"cluster_peers": ["a", 1]}`, "cluster_peers: value must be"},
+		{`{"lb_eject_after": 1.5}`, `"1.5" is not an integer`},
+		{`{"max_latency": 250}`, `"250" is not a duration`},
+		{`{"lb_ejection_time": "0s"}`, "lb_ejection_time must be positive"},
+		{`{"unknown": "x"}`, `unknown setting "unknown"`},
+	}
+	for _, tt := range tests {
+		_, _, err := loadSettings([]string{"-settings", writeSettingsFile(t, tt.content)}, nil)
+		if err == nil || !strings.Contains(err.Error(), tt.problem) {
+			t.Errorf("%s: got error %v, want one containing %q", tt.content, err, tt.problem)
+		}
+	}
+}
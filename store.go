@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const stateSaveInterval = 5 * time.Second
+
+// persistedState is everything failserver needs to carry on with a chaos
+// experiment after a restart.
+type persistedState struct {
+	Stamp         configStamp                 `json:"stamp"`
+	Config        Config                      `json:"config"`
+	Counters      map[string]map[string]int64 `json:"counters"`
+	CounterEpoch  int64                       `json:"counter_epoch,omitempty"`
+	ConfigFileSum []byte                      `json:"config_file_sum,omitempty"`
+}
+
+// stateStore snapshots the runtime state to a JSON file. The file is replaced
+// atomically so a crash while saving never leaves a truncated state behind.
+type stateStore struct {
+	path    string
+	watcher *configWatcher
+}
+
+func (s *stateStore) load() (persistedState, bool, error) {
+	var state persistedState
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return state, false, nil
+	} else if err != nil {
+		return state, false, err
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, false, err
+	}
+	return state, true, nil
+}
+
+func (s *stateStore) save() error {
+	cfg, stamp := currentConfigStamp()
+	counts, epoch := counters.snapshot()
+	state := persistedState{
+		Stamp:        stamp,
+		Config:       cfg,
+		Counters:     counts,
+		CounterEpoch: epoch,
+	}
+	if s.watcher != nil {
+		sum := s.watcher.sum()
+		state.ConfigFileSum = sum[:]
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// restore makes the saved state active. It reports whether a configuration
+// was restored.
+func (s *stateStore) restore() (bool, error) {
+	state, ok, err := s.load()
+	if err != nil || !ok {
+		return false, err
+	}
+	if err := restoreConfig(state.Config, state.Stamp, "state:"+s.path); err != nil {
+		return false, err
+	}
+	counters.merge(state.Counters, state.CounterEpoch)
+	if s.watcher != nil && len(state.ConfigFileSum) == sha256.Size {
+		var sum [sha256.Size]byte
+		copy(sum[:], state.ConfigFileSum)
+		s.watcher.setSum(sum)
+	}
+	return true, nil
+}
+
+// run saves the state periodically.
+func (s *stateStore) run() {
+	for range time.Tick(stateSaveInterval) {
+		if err := s.save(); err != nil {
+			log.Printf("Failed to save state to %s: %s\n", s.path, err)
+		}
+	}
+}
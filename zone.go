@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"net/http"
+	"time"
+)
+
+const (
+	incidentOutage    = "outage"
+	incidentLatency   = "latency"
+	incidentPartition = "partition"
+)
+
+var instanceInfo = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "failserver_instance_info",
+		Help: "Identity of this failserver instance",
+	},
+	[]string{"node", "zone", "region"},
+)
+
+// Incident is a zone or region level failure. It affects every instance whose
+// zone and region match the ones given.
+type Incident struct {
+	Name      string   `json:"name"`
+	Type      string   `json:"type"`
+	Zone      string   `json:"zone,omitempty"`
+	Region    string   `json:"region,omitempty"`
+	Latency   Duration `json:"latency,omitempty"`
+	FromZones []string `json:"from_zones,omitempty"`
+}
+
+func (inc Incident) affectsInstance() bool {
+	return (inc.Zone == "" || inc.Zone == settings.Zone) &&
+		(inc.Region == "" || inc.Region == settings.Region)
+}
+
+func (inc Incident) validate(prefix string) []string {
+	var problems []string
+	if inc.Name == "" {
+		problems = append(problems, prefix+": name is required")
+	}
+	if inc.Zone == "" && inc.Region == "" {
+		problems = append(problems, prefix+": zone or region is required")
+	}
+	switch inc.Type {
+	case incidentOutage:
+	case incidentLatency:
+		if inc.Latency <= 0 {
+			problems = append(problems, prefix+": latency must be positive")
+		}
+	case incidentPartition:
+		if len(inc.FromZones) == 0 {
+			problems = append(problems, prefix+": from_zones is required")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("%s: unknown type %q", prefix, inc.Type))
+	}
+	return problems
+}
+
+func (inc Incident) record() {
+	faultsInjected.With(prometheus.Labels{
+		"type":  "incident_" + inc.Type,
+		"rule":  inc.Name,
+		"route": "*",
+	}).Inc()
+}
+
+// applyIncidents runs the incidents that affect this instance against r and
+// reports whether the request has been fully handled.
+func applyIncidents(w http.ResponseWriter, r *http.Request, incidents []Incident) bool {
+	for _, inc := range incidents {
+		if !inc.affectsInstance() {
+			continue
+		}
+		switch inc.Type {
+		case incidentLatency:
+			inc.record()
+			injectedLatency.Observe(time.Duration(inc.Latency).Seconds())
+			time.Sleep(time.Duration(inc.Latency))
+		case incidentOutage:
+			inc.record()
+			httpRequests.With(statusCodeLabel(http.StatusServiceUnavailable)).Inc()
+			http.Error(w, fmt.Sprintf("%s is down", inc.location()), http.StatusServiceUnavailable)
+			return true
+		case incidentPartition:
+			if !containsFold(inc.FromZones, r.Header.Get(clientZoneHeader)) {
+				continue
+			}
+			inc.record()
+			dropConnection(w)
+			return true
+		}
+	}
+	return false
+}
+
+func (inc Incident) location() string {
+	if inc.Zone != "" {
+		return "Zone " + inc.Zone
+	}
+	return "Region " + inc.Region
+}
+
+// dropConnection closes the client connection without writing a response,
+// which is what a client on the far side of a network partition observes.
+func dropConnection(w http.ResponseWriter) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		panic(http.ErrAbortHandler)
+	}
+	conn, _, err := hijacker.Hijack()
+	if err != nil {
+		panic(http.ErrAbortHandler)
+	}
+	conn.Close()
+}
+
+func incidentsHandler(w http.ResponseWriter, r *http.Request) {
+	var update func(cfg *Config) error
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, currentConfig().Incidents)
+		return
+	case http.MethodPost:
+		var inc Incident
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&inc); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		update = func(cfg *Config) error {
+			cfg.Incidents = append(withoutIncident(cfg.Incidents, inc.Name), inc)
+			return nil
+		}
+	case http.MethodDelete:
+		name := r.URL.Query().Get("name")
+		update = func(cfg *Config) error {
+			remaining := withoutIncident(cfg.Incidents, name)
+			if len(remaining) == len(cfg.Incidents) {
+				return errNotFound(fmt.Sprintf("No incident named %q", name))
+			}
+			cfg.Incidents = remaining
+			return nil
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	cfg, err := updateConfig("admin:"+r.RemoteAddr, update)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	writeJSON(w, cfg.Incidents)
+}
+
+func withoutIncident(incidents []Incident, name string) []Incident {
+	out := []Incident{}
+	for _, inc := range incidents {
+		if inc.Name != name {
+			out = append(out, inc)
+		}
+	}
+	return out
+}